@@ -0,0 +1,197 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrProducerClosed is returned when msg is sent asynchronously after producer is closed
+var ErrProducerClosed = errors.New("producer is closed")
+
+const (
+	// the default max count of msgs buffered to be sent asynchronously
+	defaultAsyncBufferSize = 10000
+	// the default max count of msgs sent asynchronously in a batch
+	defaultAsyncBatchSize = 100
+	// the default max duration that msg waits in buffer for more msgs of the same batch
+	defaultAsyncLinger = 10 * time.Millisecond
+)
+
+// WithAsync sets the buffer of msgs sent asynchronously. bufferSize is the max count of msgs buffered, default 10000,
+// msgs are sent in a batch once there're batchSize msgs buffered, default 100, or the first one has waited for linger, default 10ms.
+func WithAsync(bufferSize, batchSize int, linger time.Duration) ProducerOption {
+	return func(p *ProducerCore) {
+		p.asyncBufferSize = bufferSize
+		p.asyncBatchSize = batchSize
+		p.asyncLinger = linger
+	}
+}
+
+// startAsync starts the background flusher which sends buffered msgs by producer, if it's not started
+func (p *ProducerCore) startAsync(producer BatchProducer) {
+	p.asyncMu.Lock()
+	defer p.asyncMu.Unlock()
+	if p.asyncStarted.Load() || p.asyncClosed {
+		return
+	}
+	if p.asyncBufferSize <= 0 {
+		p.asyncBufferSize = defaultAsyncBufferSize
+	}
+	if p.asyncBatchSize <= 0 {
+		p.asyncBatchSize = defaultAsyncBatchSize
+	}
+	if p.asyncLinger <= 0 {
+		p.asyncLinger = defaultAsyncLinger
+	}
+	p.asyncQueue = make(chan *Msg, p.asyncBufferSize)
+	p.asyncClosing = make(chan struct{})
+	p.flushReqs = make(chan chan struct{})
+	p.asyncDone = make(chan struct{})
+	go p.loopFlush(producer)
+	p.asyncStarted.Store(true)
+}
+
+// SendAsync buffers normal msg and returns its id, msg is sent in background and the result is reported by listener.
+// It blocks if the buffer is full, until there's room, producer is closed or Ctx is done.
+func (p *ProducerCore) SendAsync(producer BatchProducer, m *Msg) (string, error) {
+	if !p.asyncStarted.Load() {
+		p.startAsync(producer)
+	}
+	p.asyncMu.RLock()
+	if p.asyncClosed {
+		p.asyncMu.RUnlock()
+		return "", ErrProducerClosed
+	}
+	p.asyncSenders.Add(1)
+	p.asyncMu.RUnlock()
+	defer p.asyncSenders.Done()
+	if m.Id == "" {
+		m.Id = p.IdCreator.Create()
+	}
+	if p.listener != nil {
+		p.listener.PrepareSend(p.Ctx, p.Topic, m, nil)
+	}
+	select {
+	case p.asyncQueue <- m:
+		return m.Id, nil
+	case <-p.asyncClosing:
+		return "", ErrProducerClosed
+	case <-p.Ctx.Done():
+		return "", p.Ctx.Err()
+	}
+}
+
+// loopFlush sends buffered msgs in batches until the buffer is closed and drained
+func (p *ProducerCore) loopFlush(producer BatchProducer) {
+	defer close(p.asyncDone)
+	batch := make([]*Msg, 0, p.asyncBatchSize)
+	var linger <-chan time.Time
+	flush := func() {
+		if len(batch) > 0 {
+			p.report(batch, producer.PushBatch(batch))
+			batch = make([]*Msg, 0, p.asyncBatchSize)
+		}
+		linger = nil
+	}
+	add := func(m *Msg) {
+		batch = append(batch, m)
+		if len(batch) == 1 {
+			linger = time.After(p.asyncLinger)
+		}
+		if len(batch) >= p.asyncBatchSize {
+			flush()
+		}
+	}
+	for {
+		select {
+		case m, ok := <-p.asyncQueue:
+			if !ok {
+				flush()
+				return
+			}
+			add(m)
+		case <-linger:
+			flush()
+		case done := <-p.flushReqs:
+			// send the msgs buffered before flush request
+			for drained := false; !drained; {
+				select {
+				case m, ok := <-p.asyncQueue:
+					if ok {
+						add(m)
+					} else {
+						drained = true
+					}
+				default:
+					drained = true
+				}
+			}
+			flush()
+			close(done)
+		}
+	}
+}
+
+// Flush blocks until the msgs buffered before are sent or ctx is done
+func (p *ProducerCore) Flush(ctx context.Context) error {
+	if !p.asyncStarted.Load() {
+		return nil
+	}
+	done := make(chan struct{})
+	select {
+	case p.flushReqs <- done:
+	case <-p.asyncDone:
+		// msgs are flushed by Close
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops buffering msgs, and blocks until all the buffered msgs are sent or ctx is done.
+// closeProducer is called to release the connections of producer after the buffered msgs are sent,
+// if ctx is done earlier, they're still sent in background and closeProducer is called after that.
+func (p *ProducerCore) Close(ctx context.Context, closeProducer func() error) error {
+	p.asyncMu.Lock()
+	if p.asyncClosed {
+		p.asyncMu.Unlock()
+		return nil
+	}
+	p.asyncClosed = true
+	started := p.asyncStarted.Load()
+	if started {
+		close(p.asyncClosing)
+	}
+	p.asyncMu.Unlock()
+	if closeProducer == nil {
+		closeProducer = func() error { return nil }
+	}
+	if !started {
+		return closeProducer()
+	}
+	// no more senders after closed, the ones waiting for buffer quit once closing is closed
+	go func() {
+		p.asyncSenders.Wait()
+		close(p.asyncQueue)
+	}()
+	select {
+	case <-p.asyncDone:
+		return closeProducer()
+	case <-ctx.Done():
+		go func() {
+			<-p.asyncDone
+			if err := closeProducer(); err != nil {
+				fmt.Println("close producer err:", err)
+			}
+		}()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,438 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"sync"
+	"time"
+)
+
+// Codec encodes msgs into bytes and decodes them back.
+// The name of codec is recorded in each encoded msg, so that a topic with msgs encoded by different codecs can be decoded correctly.
+type Codec interface {
+	// Name returns the uniq name of codec, it must be 1 to 255 bytes long
+	Name() string
+
+	// Marshal encodes msg into bytes
+	Marshal(m *Msg) ([]byte, error)
+
+	// Unmarshal decodes bytes into msg
+	Unmarshal(data []byte, m *Msg) error
+}
+
+var (
+	// JSONCodec encodes msgs as json, numbers of Data are decoded as json.Number. It's the default codec.
+	JSONCodec Codec = jsonCodec{}
+
+	// MsgpackCodec encodes msgs as MessagePack, Data keeps integer and float types, structs are encoded as maps with json tags
+	MsgpackCodec Codec = msgpackCodec{}
+
+	// ProtobufCodec encodes msgs as protobuf, Data must be a proto.Message, and it's decoded into its original type
+	// if the type is linked into the consumer, otherwise into *anypb.Any
+	ProtobufCodec Codec = protobufCodec{}
+
+	// RawCodec keeps Data as it is, Data must be []byte or string, and it's decoded as []byte
+	RawCodec Codec = rawCodec{}
+)
+
+// codecFrameMagic is the first byte of msgs which aren't encoded by JSONCodec, json never starts with it
+const codecFrameMagic byte = 0x00
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{}
+)
+
+func init() {
+	for _, codec := range []Codec{JSONCodec, MsgpackCodec, ProtobufCodec, RawCodec} {
+		RegisterCodec(codec)
+	}
+}
+
+// RegisterCodec registers codec so that msgs encoded by it can be decoded, codec of the same name is replaced
+func RegisterCodec(codec Codec) {
+	if l := len(codec.Name()); l == 0 || l > 255 {
+		panic("codec name must be 1 to 255 bytes long")
+	}
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[codec.Name()] = codec
+}
+
+// GetCodec returns the registered codec of name
+func GetCodec(name string) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	codec, ok := codecs[name]
+	return codec, ok
+}
+
+// EncodeMsg encodes msg with codec. Msg is encoded as plain json if codec is nil or JSONCodec,
+// otherwise it's framed as: magic byte, length of codec name, codec name, and then the bytes encoded by codec.
+func EncodeMsg(codec Codec, m *Msg) ([]byte, error) {
+	if codec == nil || codec.Name() == JSONCodec.Name() {
+		return json.Marshal(m)
+	}
+	payload, err := codec.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	name := codec.Name()
+	frame := make([]byte, 0, 2+len(name)+len(payload))
+	frame = append(frame, codecFrameMagic, byte(len(name)))
+	frame = append(frame, name...)
+	return append(frame, payload...), nil
+}
+
+// DecodeMsg decodes msg encoded by EncodeMsg or MsgEncoder with the codec recorded in it, msg is decompressed if it's compressed
+func DecodeMsg(data []byte) (*Msg, error) {
+	if len(data) > 0 && data[0] == compressedFrameMagic {
+		var err error
+		if data, err = decompressFrame(data); err != nil {
+			return &Msg{}, err
+		}
+		if len(data) > 0 && data[0] == compressedFrameMagic {
+			return &Msg{}, errors.New("invalid compressed msg frame")
+		}
+	}
+	m := Msg{codec: JSONCodec}
+	if len(data) == 0 || data[0] != codecFrameMagic {
+		return &m, JSONCodec.Unmarshal(data, &m)
+	}
+	if len(data) < 2 || len(data) < 2+int(data[1]) {
+		return &m, errors.New("invalid msg frame")
+	}
+	name := string(data[2 : 2+int(data[1])])
+	codec, ok := GetCodec(name)
+	if !ok {
+		return &m, fmt.Errorf("unknown codec '%s'", name)
+	}
+	m.codec = codec
+	return &m, codec.Unmarshal(data[2+int(data[1]):], &m)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(m *Msg) ([]byte, error) {
+	return json.Marshal(m)
+}
+
+func (jsonCodec) Unmarshal(data []byte, m *Msg) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(m)
+}
+
+// DecodeData encodes data into json and decodes it into v, numbers are kept as json.Number if v holds any
+func (jsonCodec) DecodeData(data any, v any) error {
+	val, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(val))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) Marshal(m *Msg) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := msgpack.NewEncoder(&buf)
+	encoder.SetCustomStructTag("json")
+	encoder.UseCompactInts(true)
+	if err := encoder.Encode(m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, m *Msg) error {
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.SetCustomStructTag("json")
+	return decoder.Decode(m)
+}
+
+// DecodeData encodes data into MessagePack and decodes it into v
+func (msgpackCodec) DecodeData(data any, v any) error {
+	var buf bytes.Buffer
+	encoder := msgpack.NewEncoder(&buf)
+	encoder.SetCustomStructTag("json")
+	if err := encoder.Encode(data); err != nil {
+		return err
+	}
+	decoder := msgpack.NewDecoder(&buf)
+	decoder.SetCustomStructTag("json")
+	return decoder.Decode(v)
+}
+
+// the field numbers of msg encoded by protobufCodec
+const (
+	pbFieldId       protowire.Number = 1
+	pbFieldDelayAt  protowire.Number = 2 // unix nanoseconds
+	pbFieldExpireAt protowire.Number = 3 // unix nanoseconds
+	pbFieldData     protowire.Number = 4 // google.protobuf.Any
+	pbFieldAttempts protowire.Number = 5
+	pbFieldHeaders  protowire.Number = 6 // map<string, string>
+	pbFieldReplyTo  protowire.Number = 7
+	pbFieldCorrId   protowire.Number = 8
+	pbFieldPriority protowire.Number = 9
+
+	pbFieldHeaderKey   protowire.Number = 1
+	pbFieldHeaderValue protowire.Number = 2
+)
+
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string {
+	return "protobuf"
+}
+
+func (protobufCodec) Marshal(m *Msg) ([]byte, error) {
+	var b []byte
+	if m.Id != "" {
+		b = protowire.AppendTag(b, pbFieldId, protowire.BytesType)
+		b = protowire.AppendString(b, m.Id)
+	}
+	if m.DelayAt != nil {
+		b = protowire.AppendTag(b, pbFieldDelayAt, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.DelayAt.UnixNano()))
+	}
+	if m.ExpireAt != nil {
+		b = protowire.AppendTag(b, pbFieldExpireAt, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.ExpireAt.UnixNano()))
+	}
+	if m.Data != nil {
+		pm, ok := m.Data.(proto.Message)
+		if !ok {
+			return nil, fmt.Errorf("protobuf codec doesn't support data of type %T", m.Data)
+		}
+		data, err := anypb.New(pm)
+		if err != nil {
+			return nil, err
+		}
+		val, err := proto.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, pbFieldData, protowire.BytesType)
+		b = protowire.AppendBytes(b, val)
+	}
+	if m.Attempts != 0 {
+		b = protowire.AppendTag(b, pbFieldAttempts, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.Attempts))
+	}
+	if m.Priority != 0 {
+		b = protowire.AppendTag(b, pbFieldPriority, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.Priority))
+	}
+	if m.ReplyTo != "" {
+		b = protowire.AppendTag(b, pbFieldReplyTo, protowire.BytesType)
+		b = protowire.AppendString(b, m.ReplyTo)
+	}
+	if m.CorrelationId != "" {
+		b = protowire.AppendTag(b, pbFieldCorrId, protowire.BytesType)
+		b = protowire.AppendString(b, m.CorrelationId)
+	}
+	for k, v := range m.Headers {
+		var entry []byte
+		entry = protowire.AppendTag(entry, pbFieldHeaderKey, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, pbFieldHeaderValue, protowire.BytesType)
+		entry = protowire.AppendString(entry, v)
+		b = protowire.AppendTag(b, pbFieldHeaders, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b, nil
+}
+
+func (protobufCodec) Unmarshal(data []byte, m *Msg) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		switch {
+		case num == pbFieldId && typ == protowire.BytesType:
+			m.Id, n = protowire.ConsumeString(data)
+		case num == pbFieldReplyTo && typ == protowire.BytesType:
+			m.ReplyTo, n = protowire.ConsumeString(data)
+		case num == pbFieldCorrId && typ == protowire.BytesType:
+			m.CorrelationId, n = protowire.ConsumeString(data)
+		case (num == pbFieldDelayAt || num == pbFieldExpireAt) && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(data)
+			t := time.Unix(0, int64(v))
+			if num == pbFieldDelayAt {
+				m.DelayAt = &t
+			} else {
+				m.ExpireAt = &t
+			}
+		case num == pbFieldData && typ == protowire.BytesType:
+			var val []byte
+			if val, n = protowire.ConsumeBytes(data); n < 0 {
+				break
+			}
+			var a anypb.Any
+			if err := proto.Unmarshal(val, &a); err != nil {
+				return err
+			}
+			if pm, err := a.UnmarshalNew(); err == nil {
+				m.Data = pm
+			} else {
+				// the type of data isn't linked in, keep it as it is
+				m.Data = &a
+			}
+		case num == pbFieldAttempts && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(data)
+			m.Attempts = int(v)
+		case num == pbFieldPriority && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(data)
+			m.Priority = int(v)
+		case num == pbFieldHeaders && typ == protowire.BytesType:
+			var entry []byte
+			if entry, n = protowire.ConsumeBytes(data); n < 0 {
+				break
+			}
+			k, v, err := unmarshalPbHeader(entry)
+			if err != nil {
+				return err
+			}
+			m.SetHeader(k, v)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// DecodeData copies data into v, v must be a proto.Message of the same type of data
+func (protobufCodec) DecodeData(data any, v any) error {
+	dst, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("protobuf codec can't decode data into %T", v)
+	}
+	switch src := data.(type) {
+	case *anypb.Any:
+		return src.UnmarshalTo(dst)
+	case proto.Message:
+		if src.ProtoReflect().Descriptor() != dst.ProtoReflect().Descriptor() {
+			return fmt.Errorf("incompatible types: %T and %T", v, data)
+		}
+		proto.Reset(dst)
+		proto.Merge(dst, src)
+		return nil
+	default:
+		return fmt.Errorf("protobuf codec can't decode data of type %T", data)
+	}
+}
+
+// unmarshalPbHeader decodes a header entry encoded by protobufCodec
+func unmarshalPbHeader(entry []byte) (key, value string, err error) {
+	for len(entry) > 0 {
+		num, typ, n := protowire.ConsumeTag(entry)
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		entry = entry[n:]
+		switch {
+		case num == pbFieldHeaderKey && typ == protowire.BytesType:
+			key, n = protowire.ConsumeString(entry)
+		case num == pbFieldHeaderValue && typ == protowire.BytesType:
+			value, n = protowire.ConsumeString(entry)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, entry)
+		}
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		entry = entry[n:]
+	}
+	return key, value, nil
+}
+
+type rawCodec struct{}
+
+func (rawCodec) Name() string {
+	return "raw"
+}
+
+// Marshal encodes the fields except Data as json, and the json is prefixed with its length and followed by Data
+func (rawCodec) Marshal(m *Msg) ([]byte, error) {
+	var data []byte
+	switch d := m.Data.(type) {
+	case nil:
+	case []byte:
+		data = d
+	case string:
+		data = []byte(d)
+	default:
+		return nil, fmt.Errorf("raw codec doesn't support data of type %T", m.Data)
+	}
+	meta := *m
+	meta.Data = nil
+	header, err := json.Marshal(&meta)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, binary.MaxVarintLen64+len(header)+len(data))
+	b = binary.AppendUvarint(b, uint64(len(header)))
+	b = append(b, header...)
+	return append(b, data...), nil
+}
+
+func (rawCodec) Unmarshal(data []byte, m *Msg) error {
+	l, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < l {
+		return errors.New("invalid raw msg")
+	}
+	if err := json.Unmarshal(data[n:n+int(l)], m); err != nil {
+		return err
+	}
+	m.Data = append([]byte(nil), data[n+int(l):]...)
+	return nil
+}
+
+// DecodeData sets v to data, v must be *[]byte or *string
+func (rawCodec) DecodeData(data any, v any) error {
+	var b []byte
+	switch d := data.(type) {
+	case []byte:
+		b = d
+	case string:
+		b = []byte(d)
+	default:
+		return fmt.Errorf("raw codec can't decode data of type %T", data)
+	}
+	switch dst := v.(type) {
+	case *[]byte:
+		*dst = b
+	case *string:
+		*dst = string(b)
+	default:
+		return fmt.Errorf("raw codec can't decode data into %T", v)
+	}
+	return nil
+}
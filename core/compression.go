@@ -0,0 +1,165 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"sync"
+)
+
+// Compression is the algorithm with which encoded msgs are compressed
+type Compression byte
+
+const (
+	NoCompression Compression = iota
+	Gzip
+	Zstd
+	Snappy
+)
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	case Snappy:
+		return "snappy"
+	default:
+		return fmt.Sprintf("compression(%d)", byte(c))
+	}
+}
+
+// compressedFrameMagic is the first byte of compressed msgs, neither json nor codec frame starts with it
+const compressedFrameMagic byte = 0x01
+
+// the default min size in bytes of encoded msgs to compress
+const defaultCompressThreshold = 1024
+
+// the max size in bytes of a decompressed msg, so that a crafted msg can't run consumers out of memory
+const maxDecompressedSize = 64 << 20
+
+// ErrMsgTooLarge is returned when a compressed msg is larger than 64MiB after decompressed
+var ErrMsgTooLarge = errors.New("decompressed msg is too large")
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// initZstd creates the zstd encoder and decoder shared by all the msgs, they're safe for concurrent EncodeAll and DecodeAll
+func initZstd() {
+	zstdOnce.Do(func() {
+		var err error
+		if zstdEncoder, err = zstd.NewWriter(nil); err != nil {
+			panic(err)
+		}
+		if zstdDecoder, err = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedSize)); err != nil {
+			panic(err)
+		}
+	})
+}
+
+// MsgEncoder encodes msgs with Codec, and compresses the encoded msgs which aren't smaller than CompressThreshold with Compression
+type MsgEncoder struct {
+	Codec             Codec
+	Compression       Compression
+	CompressThreshold int
+}
+
+func newMsgEncoder(codec Codec, compression Compression, threshold int) MsgEncoder {
+	if threshold <= 0 {
+		threshold = defaultCompressThreshold
+	}
+	return MsgEncoder{Codec: codec, Compression: compression, CompressThreshold: threshold}
+}
+
+// Encode encodes msg, the compressed msg is framed as: magic byte, compression, and then the compressed bytes
+func (e MsgEncoder) Encode(m *Msg) ([]byte, error) {
+	data, err := EncodeMsg(e.Codec, m)
+	if err != nil || e.Compression == NoCompression || len(data) < e.CompressThreshold {
+		return data, err
+	}
+	compressed, err := compressData(e.Compression, data)
+	if err != nil {
+		return nil, err
+	}
+	if 2+len(compressed) >= len(data) {
+		// incompressible
+		return data, nil
+	}
+	frame := make([]byte, 0, 2+len(compressed))
+	frame = append(frame, compressedFrameMagic, byte(e.Compression))
+	return append(frame, compressed...), nil
+}
+
+func compressData(c Compression, data []byte) ([]byte, error) {
+	switch c {
+	case Gzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Zstd:
+		initZstd()
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case Snappy:
+		return snappy.Encode(nil, data), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %s", c)
+	}
+}
+
+// decompressFrame decompresses the msg compressed by MsgEncoder, ErrMsgTooLarge is returned if it's larger than maxDecompressedSize
+func decompressFrame(data []byte) ([]byte, error) {
+	if len(data) < 2 {
+		return nil, errors.New("invalid compressed msg frame")
+	}
+	c, data := Compression(data[1]), data[2:]
+	switch c {
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		decompressed, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(decompressed) > maxDecompressedSize {
+			return nil, ErrMsgTooLarge
+		}
+		return decompressed, nil
+	case Zstd:
+		initZstd()
+		decompressed, err := zstdDecoder.DecodeAll(data, nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+			return nil, ErrMsgTooLarge
+		}
+		return decompressed, err
+	case Snappy:
+		n, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if n > maxDecompressedSize {
+			return nil, ErrMsgTooLarge
+		}
+		return snappy.Decode(nil, data)
+	default:
+		return nil, fmt.Errorf("unsupported compression %s", c)
+	}
+}
@@ -2,9 +2,11 @@ package core
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"reflect"
 	"sync"
 	"syscall"
 	"time"
@@ -23,6 +25,9 @@ const (
 	filter       ProcessorType = 4
 )
 
+// the default interval to poll ready delay msgs
+const defaultDelayPollInterval = 100 * time.Millisecond
+
 type ConsumeFunc func(ctx context.Context, topic string, msg *Msg) error
 
 // UniqFunc returns a generated unique string that distinguishes from another model.Msg to deduplicate msgs
@@ -34,6 +39,9 @@ type DecompressFunc func(msg *Msg) []*Msg
 // CompressFunc returns compressed msgs
 type CompressFunc func(msgs []*Msg) []*Msg
 
+// ExpiredSinkFunc receives expired msgs that are dropped, such as saving them somewhere else
+type ExpiredSinkFunc func(ctx context.Context, topic string, msg *Msg) error
+
 // FilterFunc returns whether msg is permitted to be consumed. msg will be consumed if it returns true, else skipped.
 type FilterFunc func(msg *Msg) bool
 
@@ -45,12 +53,60 @@ func WithConsumerContext(ctx context.Context) ConsumerOption {
 	}
 }
 
+// WithDelayPollInterval sets the interval to poll ready delay msgs, default 100ms
+func WithDelayPollInterval(interval time.Duration) ConsumerOption {
+	return func(c *ConsumerCore) {
+		c.DelayPollInterval = interval
+	}
+}
+
+// WithConsumerCodec sets the codec with which msgs sent again by consumer are encoded, such as retried msgs, default JSONCodec.
+// Msgs are always decoded by the codec recorded in them, custom codecs must be registered by RegisterCodec.
+func WithConsumerCodec(codec Codec) ConsumerOption {
+	return func(c *ConsumerCore) {
+		c.Codec = codec
+	}
+}
+
+// WithConsumerCompression compresses msgs sent again by consumer like WithCompression, such as retried msgs.
+// Msgs are always decompressed by the compression recorded in them.
+func WithConsumerCompression(compression Compression, threshold int) ConsumerOption {
+	return func(c *ConsumerCore) {
+		c.Compression = compression
+		c.CompressThreshold = threshold
+	}
+}
+
+// WithConsumerListener sets the listener of consuming, it also implements ExpiredListener and DecodeFailListener optionally
 func WithConsumerListener(listener ConsumeListener) ConsumerOption {
 	return func(c *ConsumerCore) {
 		c.listener = listener
 	}
 }
 
+// WithExpiredSink routes expired msgs to sink before they're dropped
+func WithExpiredSink(sink ExpiredSinkFunc) ConsumerOption {
+	return func(c *ConsumerCore) {
+		c.expiredSink = sink
+	}
+}
+
+// WithRetryPolicy retries msgs failed to be consumed by policy,
+// retried msgs are sent back to consumer as delay msgs so that they survive a restart
+func WithRetryPolicy(policy *RetryPolicy) ConsumerOption {
+	return func(c *ConsumerCore) {
+		c.retryPolicy = policy
+	}
+}
+
+// WithProcessors appends processors to msg processing pipeline, they process msgs in the order of registration,
+// after the built-in ones registered by WithDecompressFunc, WithUniqFunc, WithCompressFunc and WithFilterFunc
+func WithProcessors(processors ...Processor) ConsumerOption {
+	return func(c *ConsumerCore) {
+		c.customProcessors = append(c.customProcessors, processors...)
+	}
+}
+
 func WithUniqFunc(f UniqFunc) ConsumerOption {
 	return func(c *ConsumerCore) {
 		c.uniq = f
@@ -58,6 +114,26 @@ func WithUniqFunc(f UniqFunc) ConsumerOption {
 	}
 }
 
+// WithDedupStore deduplicates msgs across batches, workers and consumers by the keys generated by UniqFunc,
+// msgs whose keys have been seen in store within window are dropped. It takes effect with WithUniqFunc.
+func WithDedupStore(store DedupStore, window time.Duration) ConsumerOption {
+	return func(c *ConsumerCore) {
+		c.dedupStore = store
+		c.dedupWindow = window
+	}
+}
+
+// WithIdempotencyStore skips msgs whose ids have been marked done in store,
+// msg id is marked done for ttl after the msg is consumed successfully.
+// Ids must be uniq among all the producers of topic, otherwise a different msg with a duplicate id is skipped,
+// see SetDefaultNode, or use WithIdCreator with a creator of uniq ids for each process.
+func WithIdempotencyStore(store IdempotencyStore, ttl time.Duration) ConsumerOption {
+	return func(c *ConsumerCore) {
+		c.idempotencyStore = store
+		c.idempotencyTTL = ttl
+	}
+}
+
 func WithDecompressFunc(f DecompressFunc) ConsumerOption {
 	return func(c *ConsumerCore) {
 		c.decompress = f
@@ -85,96 +161,77 @@ type ConsumerCore struct {
 	WorkersNum          int             // required
 	ConsumeFunc         ConsumeFunc     // required
 	listener            ConsumeListener // optional
+	expiredSink         ExpiredSinkFunc // optional
+	retryPolicy         *RetryPolicy    // optional
 	BatchProcessCnt     int             // optional
 	BatchProcessTimeout time.Duration   // optional
+	DelayPollInterval   time.Duration   // optional
+	Codec               Codec           // optional
+	Compression         Compression     // optional
+	CompressThreshold   int             // optional
 
 	// since function is not comparable and cannot be used at goset.FifoSet, use enum instead.
 	// processors records all the msg process function in sequence of priority.
-	Processors *goset.SortedSet[ProcessorType]
-	uniq       UniqFunc       // optional
-	decompress DecompressFunc // optional
-	compress   CompressFunc   // optional
-	filter     FilterFunc     // optional
+	Processors       *goset.SortedSet[ProcessorType]
+	uniq             UniqFunc         // optional
+	decompress       DecompressFunc   // optional
+	compress         CompressFunc     // optional
+	filter           FilterFunc       // optional
+	customProcessors []Processor      // optional
+	dedupStore       DedupStore       // optional
+	dedupWindow      time.Duration    // optional
+	idempotencyStore IdempotencyStore // optional
+	idempotencyTTL   time.Duration    // optional
+
+	mu          sync.Mutex
+	stopFetch   context.CancelFunc // stops fetching msgs
+	workersDone chan struct{}      // closed after all the fetched msgs are consumed
 }
 
-// fetch msgs in one fetch cycle
-func (c *ConsumerCore) fetchBatchMsgs(consumer consumer, chOut chan<- *Msg) {
-	finish := false
-	chMsg := make(chan *Msg, 1)
-
-	var wg sync.WaitGroup
-	wg.Add(2)
+const (
+	// the default max count of msgs processed in a batch
+	defaultBatchProcessCnt = 100
+	// the default max duration to wait for a batch
+	defaultBatchProcessTimeout = 10 * time.Second
+	// the max duration LoopConsume waits for fetched msgs to be consumed on quiting
+	loopConsumeShutdownTimeout = 30 * time.Second
+)
 
-	// fetch msgs
-	go func() {
-		defer wg.Done()
-		for !finish {
-			m, err := consumer.Fetch()
-			if c.listener != nil {
-				c.listener.PrepareConsume(c.Ctx, c.Topic, m, err)
-			}
-			if err != nil {
-				// fail, skip
-				fmt.Println("fetchBatchMsgs err:", err)
-				continue
-			}
-			chMsg <- m
+// fetch msgs in loop until ctx is done
+func (c *ConsumerCore) fetchMany(ctx context.Context, consumer consumer, chOut chan<- *Msg) {
+	for ctx.Err() == nil {
+		m, err := consumer.Fetch(ctx)
+		if ctx.Err() != nil && err != nil {
+			return
 		}
-		close(chMsg)
-	}()
-
-	go func() {
-		defer wg.Done()
-		// collect msgs util enough or timed out
-		fetched := 0
-		for fetched < c.BatchProcessCnt {
-			select {
-			case <-time.After(c.BatchProcessTimeout):
-				finish = true
-				return
-			case m, ok := <-chMsg:
-				if !ok {
-					return
-				}
-				chOut <- m
-				fetched++
-			}
+		if c.listener != nil {
+			c.listener.PrepareConsume(c.Ctx, c.Topic, m, err)
 		}
-		finish = true
-	}()
-
-	wg.Wait()
-}
-
-func (c *ConsumerCore) fetchMany(consumer consumer, chOut chan<- *Msg) {
-	if c.Processors.Has(compressor) || c.Processors.Has(deduplicator) {
-		// loop batch fetch msgs in limited count or limited time
-		for {
-			c.fetchBatchMsgs(consumer, chOut)
+		if err != nil {
+			// fail, skip
+			continue
 		}
-	} else {
-		// loop fetch msgs
-		for {
-			m, err := consumer.Fetch()
-			if c.listener != nil {
-				c.listener.PrepareConsume(c.Ctx, c.Topic, m, err)
-			}
-			if err != nil {
-				// fail, skip
-				continue
-			}
-			chOut <- m
+		if c.dropExpired(consumer, m) {
+			continue
 		}
+		chOut <- m
 	}
 }
 
-// fetch delay msgs that are ready to process
-func (c *ConsumerCore) fetchDelayMsgs(consumer consumer, chOut chan<- *Msg) {
-	ticker := time.NewTicker(time.Second)
+// fetch delay msgs that are ready to process until ctx is done
+func (c *ConsumerCore) fetchDelayMsgs(ctx context.Context, consumer consumer, dc delayConsumer, chOut chan<- *Msg) {
+	interval := c.DelayPollInterval
+	if interval <= 0 {
+		interval = defaultDelayPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case <-ticker.C:
-			msgs, err := consumer.FetchDelayMsgs()
+			msgs, err := dc.FetchDelayMsgs()
 			if c.listener != nil {
 				for _, m := range msgs {
 					c.listener.PrepareConsume(c.Ctx, c.Topic, m, err)
@@ -185,128 +242,314 @@ func (c *ConsumerCore) fetchDelayMsgs(consumer consumer, chOut chan<- *Msg) {
 				continue
 			}
 			for _, m := range msgs {
-				chOut <- m
+				if !c.dropExpired(consumer, m) {
+					chOut <- m
+				}
 			}
 		}
 	}
 }
 
-// fetch msgs from chIn,deduplicate,and then sent to chOut
-func (c *ConsumerCore) deduplicateMsg(chIn <-chan *Msg, chOut chan<- *Msg) {
-	for {
-		fmt.Println("deduplicateMsg new loop")
-		var msgs = make([]*Msg, 0, c.BatchProcessCnt)
-		for len(msgs) < c.BatchProcessCnt {
-			select {
-			case m := <-chIn:
-				msgs = append(msgs, m)
-			case <-time.After(c.BatchProcessTimeout):
-				goto deduplicate
-			}
-		}
-	deduplicate:
-		seen := goset.NewStrSet()
-		for _, m := range msgs {
-			id := c.uniq(m)
-			if !seen.Has(id) {
-				seen.Add(id)
-				chOut <- m
-			}
+// ack acknowledges msg if consumer supports
+func (c *ConsumerCore) ack(consumer consumer, msg *Msg) {
+	if a, ok := consumer.(acker); ok {
+		if err := a.Ack(msg); err != nil {
+			fmt.Println("ack err:", err)
 		}
 	}
 }
 
-// fetch msgs from chIn, decompress, and then sent to chOut
-func (c *ConsumerCore) decompressMsg(chIn <-chan *Msg, chOut chan<- *Msg) {
-	for msg := range chIn {
-		msgs := c.decompress(msg)
-		for _, m := range msgs {
-			chOut <- m
+// pipeline returns processors in sequence, the built-in ones come first by the order of priority,
+// and then the ones registered by WithProcessors in the order of registration
+func (c *ConsumerCore) pipeline() []Processor {
+	var processors []Processor
+	for _, pType := range c.Processors.ToList() {
+		switch pType {
+		case decompressor:
+			processors = append(processors, NewDecompressProcessor(c.decompress))
+		case deduplicator:
+			processors = append(processors, NewUniqProcessor(c.uniq, c.BatchProcessCnt, c.BatchProcessTimeout))
+			if c.dedupStore != nil {
+				processors = append(processors, NewDedupStoreProcessor(c.uniq, c.dedupStore, c.Topic, c.dedupWindow))
+			}
+		case compressor:
+			processors = append(processors, NewCompressProcessor(c.compress, c.BatchProcessCnt, c.BatchProcessTimeout))
+		case filter:
+			processors = append(processors, NewFilterProcessor(c.filter))
 		}
 	}
+	return append(processors, c.customProcessors...)
 }
 
-// fetch msgs from chIn, compress and then sent to chOut
-func (c *ConsumerCore) compressMsg(chIn <-chan *Msg, chOut chan<- *Msg) {
-	for {
-		var msgs []*Msg
-		for msg := range chIn {
-			msgs = append(msgs, msg)
-			if len(msgs) == c.BatchProcessCnt {
-				break
+// Start starts to consume msgs with multi goroutine in background, it doesn't block.
+// Msgs are fetched until ctx is done or Shutdown is called, and the fetched ones are still consumed after that.
+func (c *ConsumerCore) Start(ctx context.Context, consumer consumer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.workersDone != nil {
+		return errors.New("consumer is already started")
+	}
+	fetchCtx, stopFetch := context.WithCancel(ctx)
+	c.stopFetch = stopFetch
+	c.workersDone = make(chan struct{})
+
+	chIn := make(chan *Msg, 1024)
+
+	// fetch msgs, chIn is closed after all fetchers quit
+	var fetchers sync.WaitGroup
+	fetchers.Add(1)
+	go func() {
+		defer fetchers.Done()
+		c.fetchMany(fetchCtx, consumer, chIn)
+	}()
+	if dc, ok := consumer.(delayConsumer); ok {
+		fetchers.Add(1)
+		go func() {
+			defer fetchers.Done()
+			c.fetchDelayMsgs(fetchCtx, consumer, dc, chIn)
+		}()
+	}
+	go func() {
+		fetchers.Wait()
+		close(chIn)
+	}()
+
+	// process msgs in a pipeline, each stage's output feeds the next one,
+	// and each stage closes its output after its input is closed and drained
+	done := func(m *Msg) {
+		c.ack(consumer, m)
+	}
+	var chOut <-chan *Msg = chIn
+	for _, p := range c.pipeline() {
+		chNext := make(chan *Msg, 1024)
+		go func(p Processor, chIn <-chan *Msg, chOut chan<- *Msg) {
+			defer close(chOut)
+			p.Process(c.Ctx, chIn, chOut, done)
+		}(p, chOut, chNext)
+		chOut = chNext
+	}
+
+	// consume msgs in multi goroutines until chOut is drained
+	var workers sync.WaitGroup
+	for i := 0; i < c.WorkersNum; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for msg := range chOut {
+				c.consume(consumer, msg)
 			}
-		}
-		// compress
-		for _, m := range c.compress(msgs) {
-			chOut <- m
-		}
+		}()
 	}
+	go func() {
+		workers.Wait()
+		close(c.workersDone)
+	}()
+	return nil
 }
 
-// fetch msgs from chIn, filter and then sent to chOut
-func (c *ConsumerCore) filterMsg(chIn <-chan *Msg, chOut chan<- *Msg) {
-	for msg := range chIn {
-		if c.filter(msg) {
-			chOut <- msg
-		}
+// Shutdown stops fetching msgs, and waits until the fetched ones are consumed or ctx is done
+func (c *ConsumerCore) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	stopFetch, workersDone := c.stopFetch, c.workersDone
+	c.mu.Unlock()
+	if workersDone == nil {
+		// not started
+		return nil
+	}
+	stopFetch()
+	select {
+	case <-workersDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-// LoopConsume blocks and consumes msgs in loop with multi goroutine
+// LoopConsume blocks and consumes msgs in loop with multi goroutine, until it gets a quit signal.
+// If you'd like to handle signals by yourself, use Start and Shutdown instead.
 func (c *ConsumerCore) LoopConsume(consumer consumer) {
 	fmt.Println("start consume topic:", c.Topic)
 	var s = make(chan os.Signal, 1)
 	signal.Notify(s, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
-	// fetch msgs
-	chIn := make(chan *Msg, 1024)
-	chOut := make(chan *Msg, 1024)
-
-	// fetch msgs
-	go c.fetchDelayMsgs(consumer, chOut)
-	go c.fetchMany(consumer, chIn)
-	if c.Processors.Length() > 0 {
-		// process msgs
-		for _, pType := range c.Processors.ToList() {
-			switch pType {
-			case decompressor:
-				go c.decompressMsg(chIn, chOut)
-			case deduplicator:
-				go c.deduplicateMsg(chIn, chOut)
-			case compressor:
-				go c.compressMsg(chIn, chOut)
-			case filter:
-				go c.filterMsg(chIn, chOut)
-			}
+	defer signal.Stop(s)
+	if err := c.Start(context.Background(), consumer); err != nil {
+		fmt.Println("start consume err:", err)
+		return
+	}
+	// listen on system signal
+	sigVal := <-s
+	fmt.Printf("got signal:%v, quiting \n", sigVal)
+	ctx, cancel := context.WithTimeout(context.Background(), loopConsumeShutdownTimeout)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != nil {
+		fmt.Println("shutdown err:", err)
+	}
+}
+
+// dropExpired returns whether msg is expired, expired msg is reported and acknowledged so that it won't be redelivered
+func (c *ConsumerCore) dropExpired(consumer consumer, msg *Msg) bool {
+	if !msg.IsExpired() {
+		return false
+	}
+	if l, ok := c.listener.(ExpiredListener); ok {
+		l.OnExpired(c.Ctx, c.Topic, msg)
+	}
+	if c.expiredSink != nil {
+		if err := c.expiredSink(c.Ctx, c.Topic, msg); err != nil {
+			fmt.Println("expiredSink err:", err)
 		}
+	}
+	c.ack(consumer, msg)
+	return true
+}
+
+// ReportDecodeFail tells listener that a msg read by consumer itself can't be decoded, such as a delay msg relayed by it.
+// msg holds what's known of the bad msg, such as id.
+func (c *ConsumerCore) ReportDecodeFail(msg *Msg, err error) {
+	if l, ok := c.listener.(DecodeFailListener); ok {
+		l.OnDecodeFail(c.Ctx, c.Topic, msg, &DecodeError{Type: reflect.TypeOf(msg).Elem(), Err: err})
+	} else if c.listener != nil {
+		c.listener.OnConsumeFail(c.Ctx, c.Topic, msg, err)
+	}
+}
+
+// retry sends msg back to consumer with a backoff delay if retry policy allows, returns whether it's sent
+func (c *ConsumerCore) retry(consumer consumer, msg *Msg, err error) bool {
+	if c.retryPolicy == nil {
+		return false
+	}
+	// msg is retried only for the group it failed in if consumer supports, otherwise it's sent to topic again
+	var push func(m *Msg) error
+	if r, ok := consumer.(retrier); ok {
+		push = r.Retry
+	} else if p, ok := consumer.(Producer); ok {
+		push = p.Push
 	} else {
-		chOut = chIn
+		return false
+	}
+	attempts := msg.Attempts + 1
+	if !c.retryPolicy.shouldRetry(attempts, err) {
+		return false
 	}
+	retryMsg := *msg
+	retryMsg.Attempts = attempts
+	delayAt := time.Now().Add(c.retryPolicy.backoff(attempts))
+	retryMsg.DelayAt = &delayAt
+	if pushErr := push(&retryMsg); pushErr != nil {
+		fmt.Println("retry err:", pushErr)
+		return false
+	}
+	return true
+}
 
-	// consume msgs in multi goroutines
-	for i := 0; i < c.WorkersNum; i++ {
-		go func(no int) {
-			for {
-				msg := <-chOut
-				if c.listener == nil {
-					// _ = c.ConsumeFunc(c.Ctx, c.Topic, msg)
-					_ = c.ConsumeFunc(c.Ctx, fmt.Sprintf("%d", no), msg)
-				} else {
-					c.listener.PrepareConsume(c.Ctx, c.Topic, msg, nil)
-					if err := c.ConsumeFunc(c.Ctx, c.Topic, msg); err == nil {
-						c.listener.OnConsumeSucceed(c.Ctx, c.Topic, msg)
-					} else {
-						c.listener.OnConsumeFail(c.Ctx, c.Topic, msg, err)
-					}
-				}
-			}
-		}(i)
+// MsgEncoder returns the encoder of msgs sent again by consumer
+func (c *ConsumerCore) MsgEncoder() MsgEncoder {
+	return newMsgEncoder(c.Codec, c.Compression, c.CompressThreshold)
+}
+
+// deadLetter sends msg to dead-letter queue if consumer supports, returns whether it's sent
+func (c *ConsumerCore) deadLetter(consumer consumer, msg *Msg, err error) bool {
+	dl, ok := consumer.(deadLetterer)
+	if !ok {
+		return false
+	}
+	dead := *msg
+	dead.Attempts++
+	sent, dlErr := dl.DeadLetter(&dead, err)
+	if dlErr != nil {
+		fmt.Println("dead letter err:", dlErr)
+	}
+	return sent
+}
+
+// consume handles msg with ConsumeFunc, and acknowledges it if consumer supports
+func (c *ConsumerCore) consume(consumer consumer, msg *Msg) {
+	// msg may expire while waiting to be consumed
+	if c.dropExpired(consumer, msg) {
+		return
+	}
+	// msgs generated by processors may have no id
+	guarded := c.idempotencyStore != nil && msg.Id != ""
+	if guarded {
+		done, err := c.idempotencyStore.IsDone(c.Ctx, c.Topic, msg.Id)
+		if err != nil {
+			fmt.Println("idempotency store err:", err)
+		} else if done {
+			// redelivered msg that has been consumed
+			c.ack(consumer, msg)
+			return
+		}
+	}
+	if c.listener != nil {
+		c.listener.PrepareConsume(c.Ctx, c.Topic, msg, nil)
+	}
+	err := c.ConsumeFunc(c.Ctx, c.Topic, msg)
+	if err == nil {
+		c.sendReply(consumer, msg)
+	}
+	if err == nil && guarded {
+		if markErr := c.idempotencyStore.MarkDone(c.Ctx, c.Topic, msg.Id, c.idempotencyTTL); markErr != nil {
+			fmt.Println("idempotency store err:", markErr)
+		}
+	}
+	var decodeErr *DecodeError
+	isDecodeErr := errors.As(err, &decodeErr)
+	if c.listener != nil {
+		if err == nil {
+			c.listener.OnConsumeSucceed(c.Ctx, c.Topic, msg)
+		} else if l, ok := c.listener.(DecodeFailListener); ok && isDecodeErr {
+			l.OnDecodeFail(c.Ctx, c.Topic, msg, decodeErr)
+		} else {
+			c.listener.OnConsumeFail(c.Ctx, c.Topic, msg, err)
+		}
+	}
+	// bad data will never be decoded successfully, don't retry it
+	if err != nil && ((!isDecodeErr && c.retry(consumer, msg, err)) || c.deadLetter(consumer, msg, err)) {
+		// msg has been sent again for retry or sent to dead-letter queue, the failed one is done
+		err = nil
+	}
+	if a, ok := consumer.(acker); ok {
+		var ackErr error
+		if err == nil {
+			ackErr = a.Ack(msg)
+		} else {
+			ackErr = a.Nack(msg, err)
+		}
+		if ackErr != nil {
+			fmt.Println("ack err:", ackErr)
+		}
 	}
-	// listen on system signal
-	sigVal := <-s
-	fmt.Printf("got signal:%v, quiting \n", sigVal)
 }
 
 type consumer interface {
-	Fetch() (*Msg, error)
+	// Fetch blocks until a msg is fetched or ctx is done
+	Fetch(ctx context.Context) (*Msg, error)
+}
+
+// delayConsumer is implemented by consumers which keep delay msgs apart and need to be polled for ready ones
+type delayConsumer interface {
 	FetchDelayMsgs() ([]*Msg, error)
 }
+
+// retrier is implemented by consumers which send msgs to retry back to the group they failed in only,
+// rather than to topic which all the groups consume
+type retrier interface {
+	// Retry sends msg back to the group of consumer, it's delivered again not earlier than its delay time
+	Retry(m *Msg) error
+}
+
+// deadLetterer is implemented by consumers which keep msgs failed to be consumed in dead-letter queue
+type deadLetterer interface {
+	// DeadLetter sends msg to dead-letter queue, returns whether it's sent
+	DeadLetter(m *Msg, reason error) (bool, error)
+}
+
+// acker is implemented by consumers which support reliable delivery,
+// msgs are removed from consumer only after they're acknowledged
+type acker interface {
+	// Ack acknowledges msg is consumed successfully
+	Ack(m *Msg) error
+
+	// Nack tells consumer that msg is failed to be consumed
+	Nack(m *Msg, err error) error
+}
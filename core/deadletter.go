@@ -0,0 +1,58 @@
+package core
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// DeadLetter is a msg that can't be consumed successfully, which is kept in dead-letter queue
+type DeadLetter struct {
+	Id       string    `json:"id"`        // msg id, it's empty if msg can't be decoded
+	Payload  []byte    `json:"payload"`   // the original encoded msg, it may be binary
+	Reason   string    `json:"reason"`    // the reason why msg is dead
+	Attempts int       `json:"attempts"`  // the count of failed attempts to consume the msg
+	FailedAt time.Time `json:"failed_at"` // the time at which msg failed for the last time
+
+	Headers map[string]string `json:"headers,omitempty"` // headers of the msg, in case they aren't kept in the payload
+}
+
+// NewDeadLetter returns a dead letter of the original encoded msg
+func NewDeadLetter(m *Msg, payload []byte, reason error) *DeadLetter {
+	d := &DeadLetter{
+		Payload:  payload,
+		FailedAt: time.Now(),
+	}
+	if m != nil {
+		d.Id = m.Id
+		d.Attempts = m.Attempts
+		d.Headers = m.Headers
+	}
+	if reason != nil {
+		d.Reason = reason.Error()
+	}
+	return d
+}
+
+// Msg decodes the original msg, attempts and delay time are reset so that it can be consumed again
+func (d *DeadLetter) Msg() (*Msg, error) {
+	m, err := DecodeMsgFromBytes(d.Payload)
+	if err != nil {
+		return nil, err
+	}
+	m.Attempts = 0
+	m.DelayAt = nil
+	if m.Headers == nil {
+		m.Headers = d.Headers
+	}
+	return m, nil
+}
+
+func (d *DeadLetter) Encode() ([]byte, error) {
+	return json.Marshal(d)
+}
+
+func DecodeDeadLetter(data []byte) (*DeadLetter, error) {
+	var d DeadLetter
+	err := json.Unmarshal(data, &d)
+	return &d, err
+}
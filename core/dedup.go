@@ -0,0 +1,113 @@
+package core
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DedupStore records uniq keys of msgs in a time window, so that msgs can be deduplicated across batches, workers and consumers
+type DedupStore interface {
+	// Seen marks key of topic as seen by msg id for window, and returns whether it has been seen by another msg within window before.
+	// The msg of the same id is a redelivery rather than a duplicate, it isn't seen unless id is empty.
+	Seen(ctx context.Context, topic, key, id string, window time.Duration) (bool, error)
+}
+
+// NewDedupStoreProcessor returns a Processor that drops msgs whose uniq keys generated by f have been seen in store within window.
+// Retried and redelivered msgs are never dropped since their keys are seen by themselves. If store fails, msg is kept.
+func NewDedupStoreProcessor(f UniqFunc, store DedupStore, topic string, window time.Duration) Processor {
+	return ProcessorFunc(func(ctx context.Context, in <-chan *Msg, out chan<- *Msg, done func(m *Msg)) {
+		for msg := range in {
+			if msg.Attempts == 0 {
+				seen, err := store.Seen(ctx, topic, f(msg), msg.Id, window)
+				if err != nil {
+					fmt.Println("dedup store err:", err)
+				} else if seen {
+					done(msg)
+					continue
+				}
+			}
+			out <- msg
+		}
+	})
+}
+
+// lruCache is a concurrency safe LRU cache whose entries expire
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  *list.List // the front is the most recently used
+	index    map[string]*list.Element
+}
+
+type lruEntry struct {
+	key      string
+	value    string
+	expireAt time.Time
+}
+
+func newLRUCache(capacity int) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		entries:  list.New(),
+		index:    make(map[string]*list.Element),
+	}
+}
+
+// has returns whether key exists and isn't expired
+func (l *lruCache) has(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.index[key]
+	if !ok {
+		return false
+	}
+	if !e.Value.(*lruEntry).expireAt.After(time.Now()) {
+		l.entries.Remove(e)
+		delete(l.index, key)
+		return false
+	}
+	l.entries.MoveToFront(e)
+	return true
+}
+
+// setNX sets key to value with ttl if it doesn't exist or is expired, returns whether it's set and the value of key
+func (l *lruCache) setNX(key, value string, ttl time.Duration) (bool, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if e, ok := l.index[key]; ok {
+		entry := e.Value.(*lruEntry)
+		l.entries.MoveToFront(e)
+		if entry.expireAt.After(now) {
+			return false, entry.value
+		}
+		entry.value = value
+		entry.expireAt = now.Add(ttl)
+		return true, value
+	}
+	l.index[key] = l.entries.PushFront(&lruEntry{key: key, value: value, expireAt: now.Add(ttl)})
+	for l.entries.Len() > l.capacity {
+		oldest := l.entries.Back()
+		l.entries.Remove(oldest)
+		delete(l.index, oldest.Value.(*lruEntry).key)
+	}
+	return true, value
+}
+
+// MemoryDedupStore is a DedupStore in memory, the least recently seen keys are evicted when it's full
+type MemoryDedupStore struct {
+	cache *lruCache
+}
+
+// NewMemoryDedupStore returns a DedupStore in memory that keeps at most capacity keys
+func NewMemoryDedupStore(capacity int) *MemoryDedupStore {
+	return &MemoryDedupStore{cache: newLRUCache(capacity)}
+}
+
+func (s *MemoryDedupStore) Seen(ctx context.Context, topic, key, id string, window time.Duration) (bool, error) {
+	set, seenBy := s.cache.setNX(topic+":"+key, id, window)
+	return !set && (id == "" || seenBy != id), nil
+}
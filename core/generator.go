@@ -1,18 +1,53 @@
 package core
 
-import "github.com/bwmarrin/snowflake"
+import (
+	"math/rand"
+	"sync"
+
+	"github.com/bwmarrin/snowflake"
+)
 
 type IdCreator interface {
 	Create() string
 }
 
-type SnowflakeCreator struct{ node int64 }
+// DefaultIdCreator is shared by all the producers in the process unless WithIdCreator is used,
+// so that their ids don't duplicate. Its snowflake node is random unless SetDefaultNode is called.
+var DefaultIdCreator = NewSnowflakeCreator(-1)
+
+// SetDefaultNode sets the snowflake node of DefaultIdCreator, it must be called before any producer is created.
+// Random nodes of processes may collide, give each process of a topic a unique node in [0, 1023] if ids must be uniq,
+// for example, when msgs are deduplicated by WithIdempotencyStore.
+func SetDefaultNode(node int64) {
+	DefaultIdCreator = NewSnowflakeCreator(node)
+}
+
+type SnowflakeCreator struct {
+	node int64
+
+	// the snowflake node keeps the sequence of ids generated in the same millisecond,
+	// so it must be shared by all the ids, otherwise they may duplicate
+	once      sync.Once
+	generator *snowflake.Node
+	err       error
+}
 
+// NewSnowflakeCreator returns an IdCreator of snowflake node, the node is random if it's negative.
+// Ids of creators of the same node may duplicate, share a creator among producers rather than creating one for each.
 func NewSnowflakeCreator(node int64) *SnowflakeCreator {
 	return &SnowflakeCreator{node: node}
 }
 
 func (s *SnowflakeCreator) Create() string {
-	node, _ := snowflake.NewNode(s.node)
-	return node.Generate().String()
+	s.once.Do(func() {
+		node := s.node
+		if node < 0 {
+			node = rand.Int63n(1 << snowflake.NodeBits)
+		}
+		s.generator, s.err = snowflake.NewNode(node)
+	})
+	if s.err != nil {
+		panic(s.err)
+	}
+	return s.generator.Generate().String()
 }
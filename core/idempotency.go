@@ -0,0 +1,34 @@
+package core
+
+import (
+	"context"
+	"time"
+)
+
+// IdempotencyStore records ids of msgs consumed successfully, so that redelivered msgs are consumed only once
+type IdempotencyStore interface {
+	// IsDone returns whether msg id of topic has been consumed successfully
+	IsDone(ctx context.Context, topic, id string) (bool, error)
+
+	// MarkDone marks msg id of topic as consumed successfully for ttl
+	MarkDone(ctx context.Context, topic, id string, ttl time.Duration) error
+}
+
+// MemoryIdempotencyStore is an IdempotencyStore in memory, the least recently used ids are evicted when it's full
+type MemoryIdempotencyStore struct {
+	cache *lruCache
+}
+
+// NewMemoryIdempotencyStore returns an IdempotencyStore in memory that keeps at most capacity ids
+func NewMemoryIdempotencyStore(capacity int) *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{cache: newLRUCache(capacity)}
+}
+
+func (s *MemoryIdempotencyStore) IsDone(ctx context.Context, topic, id string) (bool, error) {
+	return s.cache.has(topic + ":" + id), nil
+}
+
+func (s *MemoryIdempotencyStore) MarkDone(ctx context.Context, topic, id string, ttl time.Duration) error {
+	s.cache.setNX(topic+":"+id, "", ttl)
+	return nil
+}
@@ -25,3 +25,16 @@ type ConsumeListener interface {
 	// OnConsumeFail does something when data is failed to handled by your handler logic
 	OnConsumeFail(ctx context.Context, topic string, msg *Msg, err error)
 }
+
+// ExpiredListener is optionally implemented by ConsumeListener to know expired msgs
+type ExpiredListener interface {
+	// OnExpired does something when msg is expired and dropped without being handled
+	OnExpired(ctx context.Context, topic string, msg *Msg)
+}
+
+// DecodeFailListener is optionally implemented by ConsumeListener to know msgs whose data can't be decoded
+type DecodeFailListener interface {
+	// OnDecodeFail does something when data of msg can't be decoded into the type wanted by your handler,
+	// OnConsumeFail isn't called in this case
+	OnDecodeFail(ctx context.Context, topic string, msg *Msg, err *DecodeError)
+}
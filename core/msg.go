@@ -1,12 +1,10 @@
 package core
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 	"github.com/mitchellh/mapstructure"
+	"google.golang.org/protobuf/proto"
 	"reflect"
-	"strings"
 	"time"
 )
 
@@ -15,6 +13,45 @@ type Msg struct {
 	DelayAt  *time.Time `json:"delay_at,omitempty"`  // the time at which the msg will be processed at, it must be later than now
 	ExpireAt *time.Time `json:"expire_at,omitempty"` // the time at which the msg will expire
 	Data     any        `json:"data"`                // data that will be transferred
+	Attempts int        `json:"attempts,omitempty"`  // the count of failed attempts to consume the msg
+	Priority int        `json:"priority,omitempty"`  // the larger the more urgent, only supported by redis list backend
+
+	Headers map[string]string `json:"headers,omitempty"` // metadata of the msg, such as trace id, tenant id and content type
+
+	ReplyTo       string `json:"reply_to,omitempty"`       // the destination to which the reply of a request msg is sent
+	CorrelationId string `json:"correlation_id,omitempty"` // the id with which a reply is matched with its request
+
+	ackToken any   // backend specific token used to acknowledge the msg, set by consumer
+	codec    Codec // the codec by which the msg is decoded
+	reply    *Msg  // the reply of a request msg, set by ReplyHandler
+}
+
+// IsExpired returns whether msg is expired
+func (m *Msg) IsExpired() bool {
+	return m.ExpireAt != nil && !m.ExpireAt.After(time.Now())
+}
+
+// Header returns the value of header key, or empty string if it's missing
+func (m *Msg) Header(key string) string {
+	return m.Headers[key]
+}
+
+// SetHeader sets header key to value
+func (m *Msg) SetHeader(key, value string) {
+	if m.Headers == nil {
+		m.Headers = make(map[string]string)
+	}
+	m.Headers[key] = value
+}
+
+// SetAckToken sets the token with which the consumer backend acknowledges the msg
+func (m *Msg) SetAckToken(token any) {
+	m.ackToken = token
+}
+
+// AckToken returns the token with which the consumer backend acknowledges the msg
+func (m *Msg) AckToken() any {
+	return m.ackToken
 }
 
 type MsgOption func(m *Msg)
@@ -34,7 +71,35 @@ func WithExpireTime(expireAt *time.Time) MsgOption {
 			panic("expire time must be later than delay time")
 		}
 		if !expireAt.After(time.Now()) {
-			panic("delay time must be later than now")
+			panic("expire time must be later than now")
+		}
+		m.ExpireAt = expireAt
+	}
+}
+
+// WithPriority sets priority of msg, msgs of higher priority are consumed first.
+// It's clamped into [0, RConf.Priorities-1] by redis list backend, and ignored by others.
+func WithPriority(priority int) MsgOption {
+	return func(m *Msg) {
+		if priority < 0 {
+			panic("priority must not be negative")
+		}
+		m.Priority = priority
+	}
+}
+
+// WithHeader sets header key of msg to value
+func WithHeader(key, value string) MsgOption {
+	return func(m *Msg) {
+		m.SetHeader(key, value)
+	}
+}
+
+// WithHeaders sets headers of msg, existing headers of the same keys are overwritten
+func WithHeaders(headers map[string]string) MsgOption {
+	return func(m *Msg) {
+		for k, v := range headers {
+			m.SetHeader(k, v)
 		}
 	}
 }
@@ -47,21 +112,40 @@ func NewMsg(data any, opts ...MsgOption) *Msg {
 	return msg
 }
 
+// NewMsgs returns msgs of the data items with the same options
+func NewMsgs(items []any, opts ...MsgOption) []*Msg {
+	ms := make([]*Msg, len(items))
+	for i, item := range items {
+		ms[i] = NewMsg(item, opts...)
+	}
+	return ms
+}
+
 // ParseFromMsg decodes m.Data into s, and s must be a pointer
 func ParseFromMsg(m *Msg, s interface{}) error {
 	targetValue := reflect.ValueOf(s)
 	if targetValue.Kind() != reflect.Ptr {
 		return fmt.Errorf("incompatible types: %T and %T", s, m.Data)
 	}
+	// If Data is a protobuf msg, copy it into s of the same type
+	if src, ok := m.Data.(proto.Message); ok {
+		if dst, ok := s.(proto.Message); ok {
+			if src.ProtoReflect().Descriptor() != dst.ProtoReflect().Descriptor() {
+				return fmt.Errorf("incompatible types: %T and %T", s, m.Data)
+			}
+			proto.Reset(dst)
+			proto.Merge(dst, src)
+			return nil
+		}
+	}
 	// Handle different types of Data
 	switch data := m.Data.(type) {
 	case map[string]interface{}:
 		// If Data is a map, decode it into s
 		return mapstructure.Decode(m.Data, s)
-	case string, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, bool:
-		// If Data is a basic type, assign it directly to s
-		targetValue.Elem().Set(reflect.ValueOf(m.Data))
-		return nil
+	case []byte, string, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, bool:
+		// If Data is a basic type, assign or convert it to s
+		return assignBasic(targetValue.Elem(), reflect.ValueOf(m.Data))
 	default:
 		// If Data is a struct, struct pointer, or slice, handle it accordingly
 		config := &mapstructure.DecoderConfig{
@@ -76,18 +160,27 @@ func ParseFromMsg(m *Msg, s interface{}) error {
 	}
 }
 
+// assignBasic assigns src of basic type to dst, src is converted if it's convertible to the type of dst,
+// such as []byte to string and float64 to int. Integers aren't converted to string, which would be runes.
+func assignBasic(dst, src reflect.Value) error {
+	if src.Type().AssignableTo(dst.Type()) {
+		dst.Set(src)
+		return nil
+	}
+	isInt := src.CanInt() || src.CanUint()
+	if !src.Type().ConvertibleTo(dst.Type()) || (isInt && dst.Kind() == reflect.String) {
+		return fmt.Errorf("incompatible types: %s and %s", dst.Type(), src.Type())
+	}
+	dst.Set(src.Convert(dst.Type()))
+	return nil
+}
+
+// DecodeMsgFromBytes decodes msg encoded by any registered codec
 func DecodeMsgFromBytes(data []byte) (*Msg, error) {
-	var m Msg
-	decoder := json.NewDecoder(bytes.NewReader(data))
-	decoder.UseNumber()
-	err := decoder.Decode(&m)
-	return &m, err
+	return DecodeMsg(data)
 }
 
+// DecodeMsgFromStr decodes msg encoded by any registered codec
 func DecodeMsgFromStr(data string) (*Msg, error) {
-	var m Msg
-	decoder := json.NewDecoder(strings.NewReader(data))
-	decoder.UseNumber()
-	err := decoder.Decode(&m)
-	return &m, err
+	return DecodeMsg([]byte(data))
 }
@@ -0,0 +1,149 @@
+package core
+
+import (
+	"context"
+	"time"
+
+	"github.com/Visforest/goset/v2"
+)
+
+// Processor is a stage of msg processing pipeline, which runs before msgs are consumed
+type Processor interface {
+	// Process reads msgs from in, and sends the processed ones to out, it returns after in is closed and drained.
+	// The msgs dropped or replaced by others must be passed to done, so that they're acknowledged and won't be redelivered.
+	Process(ctx context.Context, in <-chan *Msg, out chan<- *Msg, done func(m *Msg))
+}
+
+// ProcessorFunc is an adapter to use ordinary function as Processor
+type ProcessorFunc func(ctx context.Context, in <-chan *Msg, out chan<- *Msg, done func(m *Msg))
+
+func (f ProcessorFunc) Process(ctx context.Context, in <-chan *Msg, out chan<- *Msg, done func(m *Msg)) {
+	f(ctx, in, out, done)
+}
+
+// BatchProcessor processes msgs in batch
+type BatchProcessor interface {
+	// ProcessBatch returns the processed msgs, msgs missing in result are considered done
+	ProcessBatch(ctx context.Context, msgs []*Msg) []*Msg
+}
+
+// BatchProcessorFunc is an adapter to use ordinary function as BatchProcessor
+type BatchProcessorFunc func(ctx context.Context, msgs []*Msg) []*Msg
+
+func (f BatchProcessorFunc) ProcessBatch(ctx context.Context, msgs []*Msg) []*Msg {
+	return f(ctx, msgs)
+}
+
+// NewBatchProcessor returns a Processor that collects at most batch msgs, or msgs that come until no more msg comes within timeout,
+// and then processes them by p. batch and timeout take default value 100 and 10s if they're not positive.
+func NewBatchProcessor(p BatchProcessor, batch int, timeout time.Duration) Processor {
+	if batch <= 0 {
+		batch = defaultBatchProcessCnt
+	}
+	if timeout <= 0 {
+		timeout = defaultBatchProcessTimeout
+	}
+	return &batchProcessor{p: p, batch: batch, timeout: timeout}
+}
+
+type batchProcessor struct {
+	p       BatchProcessor
+	batch   int
+	timeout time.Duration
+}
+
+func (b *batchProcessor) Process(ctx context.Context, in <-chan *Msg, out chan<- *Msg, done func(m *Msg)) {
+	for {
+		msgs, ok := collectBatch(in, b.batch, b.timeout)
+		if len(msgs) > 0 {
+			result := b.p.ProcessBatch(ctx, msgs)
+			doneReplaced(msgs, result, done)
+			for _, m := range result {
+				out <- m
+			}
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// collectBatch collects msgs from in until the count reaches batch or no more msg comes within timeout.
+// It returns false if in is closed.
+func collectBatch(in <-chan *Msg, batch int, timeout time.Duration) ([]*Msg, bool) {
+	msgs := make([]*Msg, 0, batch)
+	for len(msgs) < batch {
+		select {
+		case m, ok := <-in:
+			if !ok {
+				return msgs, false
+			}
+			msgs = append(msgs, m)
+		case <-time.After(timeout):
+			return msgs, true
+		}
+	}
+	return msgs, true
+}
+
+// doneReplaced passes the msgs in origin which are missing in result to done
+func doneReplaced(origin []*Msg, result []*Msg, done func(m *Msg)) {
+	kept := make(map[*Msg]struct{}, len(result))
+	for _, m := range result {
+		kept[m] = struct{}{}
+	}
+	for _, m := range origin {
+		if _, ok := kept[m]; !ok {
+			done(m)
+		}
+	}
+}
+
+// NewUniqProcessor returns a Processor that deduplicates msgs by f in batch
+func NewUniqProcessor(f UniqFunc, batch int, timeout time.Duration) Processor {
+	return NewBatchProcessor(BatchProcessorFunc(func(ctx context.Context, msgs []*Msg) []*Msg {
+		seen := goset.NewStrSet()
+		result := make([]*Msg, 0, len(msgs))
+		for _, m := range msgs {
+			id := f(m)
+			if !seen.Has(id) {
+				seen.Add(id)
+				result = append(result, m)
+			}
+		}
+		return result
+	}), batch, timeout)
+}
+
+// NewCompressProcessor returns a Processor that compresses msgs by f in batch
+func NewCompressProcessor(f CompressFunc, batch int, timeout time.Duration) Processor {
+	return NewBatchProcessor(BatchProcessorFunc(func(ctx context.Context, msgs []*Msg) []*Msg {
+		return f(msgs)
+	}), batch, timeout)
+}
+
+// NewDecompressProcessor returns a Processor that decompresses each msg by f
+func NewDecompressProcessor(f DecompressFunc) Processor {
+	return ProcessorFunc(func(ctx context.Context, in <-chan *Msg, out chan<- *Msg, done func(m *Msg)) {
+		for msg := range in {
+			msgs := f(msg)
+			doneReplaced([]*Msg{msg}, msgs, done)
+			for _, m := range msgs {
+				out <- m
+			}
+		}
+	})
+}
+
+// NewFilterProcessor returns a Processor that filters each msg by f
+func NewFilterProcessor(f FilterFunc) Processor {
+	return ProcessorFunc(func(ctx context.Context, in <-chan *Msg, out chan<- *Msg, done func(m *Msg)) {
+		for msg := range in {
+			if f(msg) {
+				out <- msg
+			} else {
+				done(msg)
+			}
+		}
+	})
+}
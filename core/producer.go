@@ -2,6 +2,10 @@ package core
 
 import (
 	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type ProducerOption func(producer *ProducerCore)
@@ -24,17 +28,56 @@ func WithProducerListener(listener ProducerListener) ProducerOption {
 	}
 }
 
+// WithProducerCodec sets the codec with which msgs are encoded, default JSONCodec
+func WithProducerCodec(codec Codec) ProducerOption {
+	return func(p *ProducerCore) {
+		p.Codec = codec
+	}
+}
+
+// WithCompression compresses the encoded msgs which aren't smaller than threshold bytes with compression,
+// threshold is 1024 if it's not positive
+func WithCompression(compression Compression, threshold int) ProducerOption {
+	return func(p *ProducerCore) {
+		p.Compression = compression
+		p.CompressThreshold = threshold
+	}
+}
+
 type ProducerCore struct {
-	Ctx       context.Context
-	Topic     string
-	IdCreator IdCreator
-	listener  ProducerListener
+	Ctx               context.Context
+	Topic             string
+	IdCreator         IdCreator
+	Codec             Codec
+	Compression       Compression
+	CompressThreshold int
+	listener          ProducerListener
+
+	// for sending msgs asynchronously
+	asyncBufferSize int
+	asyncBatchSize  int
+	asyncLinger     time.Duration
+	asyncMu         sync.RWMutex
+	asyncStarted    atomic.Bool
+	asyncClosed     bool
+	asyncSenders    sync.WaitGroup     // SendAsync calls in progress
+	asyncClosing    chan struct{}      // closed by Close, senders waiting for buffer quit
+	asyncQueue      chan *Msg          // buffered msgs, closed after all the senders quit
+	flushReqs       chan chan struct{} // the channel is closed after msgs buffered before are sent
+	asyncDone       chan struct{}      // closed after all the buffered msgs are sent
+}
+
+// MsgEncoder returns the encoder of msgs sent by producer
+func (p *ProducerCore) MsgEncoder() MsgEncoder {
+	return newMsgEncoder(p.Codec, p.Compression, p.CompressThreshold)
 }
 
-// Send sends normal msg
+// Send sends normal msg, msg id is generated unless it's set, such as the msg relayed from outbox
 func (p *ProducerCore) Send(producer Producer, m *Msg) (string, error) {
 	// generate msg id
-	m.Id = p.IdCreator.Create()
+	if m.Id == "" {
+		m.Id = p.IdCreator.Create()
+	}
 	var err error
 
 	if p.listener == nil {
@@ -55,6 +98,86 @@ func (p *ProducerCore) Send(producer Producer, m *Msg) (string, error) {
 	return m.Id, err
 }
 
+// SendBatch sends normal msgs in a batch, ids of msgs are returned in order, and the id of msg failed to be sent is empty.
+// If some msgs are failed to be sent, a *BatchError is returned.
+func (p *ProducerCore) SendBatch(producer BatchProducer, ms []*Msg) ([]string, error) {
+	for _, m := range ms {
+		if m.Id == "" {
+			m.Id = p.IdCreator.Create()
+		}
+		if p.listener != nil {
+			p.listener.PrepareSend(p.Ctx, p.Topic, m, nil)
+		}
+	}
+	return p.report(ms, producer.PushBatch(ms))
+}
+
+// report calls listener with the result of each msg, and returns ids and error like SendBatch
+func (p *ProducerCore) report(ms []*Msg, errs []error) ([]string, error) {
+	ids := make([]string, len(ms))
+	var batchErr *BatchError
+	for i, m := range ms {
+		var err error
+		if errs != nil {
+			err = errs[i]
+		}
+		if err != nil {
+			if batchErr == nil {
+				batchErr = &BatchError{Errs: make([]error, len(ms))}
+			}
+			batchErr.Errs[i] = err
+			if p.listener != nil {
+				p.listener.OnSendFail(p.Ctx, p.Topic, m, err)
+			}
+			continue
+		}
+		ids[i] = m.Id
+		if p.listener != nil {
+			p.listener.OnSendSucceed(p.Ctx, p.Topic, m)
+		}
+	}
+	if batchErr != nil {
+		return ids, batchErr
+	}
+	return ids, nil
+}
+
 type Producer interface {
 	Push(m *Msg) error
 }
+
+// BatchProducer is implemented by producers which send msgs in a batch
+type BatchProducer interface {
+	// PushBatch sends msgs, it returns nil if all the msgs are sent, otherwise the errors of msgs in order
+	PushBatch(ms []*Msg) []error
+}
+
+// BatchError tells which msgs of a batch are failed to be sent
+type BatchError struct {
+	Errs []error // the errors of msgs in order, it's nil if the msg is sent
+}
+
+func (e *BatchError) Error() string {
+	var failed int
+	var first error
+	for _, err := range e.Errs {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+	return fmt.Sprintf("%d of %d msgs failed to be sent, first err: %v", failed, len(e.Errs), first)
+}
+
+// Unwrap returns the errors of msgs failed to be sent
+func (e *BatchError) Unwrap() []error {
+	var errs []error
+	for _, err := range e.Errs {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,85 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ReplyFunc handles request msg and returns the data replied to the requester
+type ReplyFunc func(ctx context.Context, topic string, msg *Msg) (any, error)
+
+// ReplyHandler adapts f into a ConsumeFunc, the data returned by f is replied to the requester if msg is a request.
+// Nothing is replied if f fails, and the requester waits until its ctx is done.
+func ReplyHandler(f ReplyFunc) ConsumeFunc {
+	return func(ctx context.Context, topic string, msg *Msg) error {
+		data, err := f(ctx, topic, msg)
+		if err != nil {
+			return err
+		}
+		if msg.ReplyTo != "" {
+			reply := NewMsg(data)
+			reply.Id = msg.Id
+			reply.CorrelationId = msg.CorrelationId
+			msg.reply = reply
+		}
+		return nil
+	}
+}
+
+// ReplyInbox is implemented by producers which receive replies of requests
+type ReplyInbox interface {
+	// Subscribe starts to receive the reply of correlation id, it returns the reply destination of request,
+	// a channel from which the reply is received, and a func to stop receiving
+	Subscribe(correlationId string) (replyTo string, replies <-chan *Msg, cancel func(), err error)
+}
+
+// replier is implemented by consumers which send replies of requests
+type replier interface {
+	// Reply sends reply to the destination
+	Reply(replyTo string, reply *Msg) error
+}
+
+// Request sends request msg, and blocks until its reply is received or ctx is done.
+// Msg expires at the deadline of ctx unless its expire time is set, so that it won't be handled after the requester gives up.
+func (p *ProducerCore) Request(ctx context.Context, producer Producer, inbox ReplyInbox, m *Msg) (*Msg, error) {
+	if m.Id == "" {
+		m.Id = p.IdCreator.Create()
+	}
+	if deadline, ok := ctx.Deadline(); ok && m.ExpireAt == nil {
+		m.ExpireAt = &deadline
+	}
+	m.CorrelationId = m.Id
+	replyTo, replies, cancel, err := inbox.Subscribe(m.CorrelationId)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	m.ReplyTo = replyTo
+	if _, err = p.Send(producer, m); err != nil {
+		return nil, err
+	}
+	select {
+	case reply, ok := <-replies:
+		if !ok {
+			return nil, errors.New("reply inbox is closed")
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// sendReply sends the reply of msg if there's one
+func (c *ConsumerCore) sendReply(consumer consumer, msg *Msg) {
+	if msg.reply == nil || msg.ReplyTo == "" {
+		return
+	}
+	r, ok := consumer.(replier)
+	if !ok {
+		return
+	}
+	if err := r.Reply(msg.ReplyTo, msg.reply); err != nil {
+		fmt.Println("reply err:", err)
+	}
+}
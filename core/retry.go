@@ -0,0 +1,95 @@
+package core
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy decides whether and when a msg failed to be consumed will be consumed again
+type RetryPolicy struct {
+	// the max count of attempts to consume a msg, including the first one, default 3
+	MaxAttempts int
+
+	// the backoff before the first retry, default 1s
+	InitialBackoff time.Duration
+
+	// the max backoff between two attempts, default 10min
+	MaxBackoff time.Duration
+
+	// the factor by which backoff grows after each retry, default 2
+	Multiplier float64
+
+	// the ratio of backoff randomized to avoid retrying at the same time, in range [0,1], default 0
+	Jitter float64
+
+	// returns whether err is retryable, optional. All errors but the ones wrapped by Permanent are retryable if it's missing
+	Retryable func(err error) bool
+}
+
+// shouldRetry returns whether msg that has been failed to be consumed for attempts times should be retried
+func (p *RetryPolicy) shouldRetry(attempts int, err error) bool {
+	maxAttempts := p.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 3
+	}
+	if attempts >= maxAttempts || IsPermanent(err) {
+		return false
+	}
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return true
+}
+
+// backoff returns the duration to wait before the retry following attempts failed attempts
+func (p *RetryPolicy) backoff(attempts int) time.Duration {
+	initial := p.InitialBackoff
+	if initial <= 0 {
+		initial = time.Second
+	}
+	maxBackoff := p.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 10 * time.Minute
+	}
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	backoff := float64(initial) * math.Pow(multiplier, float64(attempts-1))
+	if backoff > float64(maxBackoff) {
+		backoff = float64(maxBackoff)
+	}
+	if p.Jitter > 0 {
+		jitter := math.Min(p.Jitter, 1)
+		backoff = backoff * (1 - jitter + 2*jitter*rand.Float64())
+	}
+	return time.Duration(backoff)
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent wraps err to tell that the msg should never be retried
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent returns whether err is wrapped by Permanent
+func IsPermanent(err error) bool {
+	var e *permanentError
+	return errors.As(err, &e)
+}
@@ -0,0 +1,73 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// TypedConsumeFunc handles msg whose data has been decoded into T
+type TypedConsumeFunc[T any] func(ctx context.Context, topic string, msg *Msg, data T) error
+
+// TypedHandler adapts f into a ConsumeFunc, data of msg is decoded into T before f is called.
+// If data can't be decoded, a *DecodeError is returned, OnDecodeFail of listener is called if it implements DecodeFailListener,
+// otherwise OnConsumeFail, and msg isn't retried.
+func TypedHandler[T any](f TypedConsumeFunc[T]) ConsumeFunc {
+	return func(ctx context.Context, topic string, msg *Msg) error {
+		data, err := DecodeData[T](msg)
+		if err != nil {
+			return err
+		}
+		return f(ctx, topic, msg, data)
+	}
+}
+
+// DecodeError tells that data of msg can't be decoded into the type wanted
+type DecodeError struct {
+	Type reflect.Type // the type wanted
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decode data into %s err: %s", e.Type, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// DataDecoder is implemented by codecs which decode data of msgs decoded by them into specified types
+type DataDecoder interface {
+	// DecodeData decodes data into v, v is a pointer
+	DecodeData(data any, v any) error
+}
+
+// DecodeData decodes data of msg into T with the codec by which msg is decoded, it returns a *DecodeError if fails
+func DecodeData[T any](m *Msg) (T, error) {
+	var data T
+	if d, ok := m.Data.(T); ok {
+		return d, nil
+	}
+	// decode into the value pointed by T if T is a pointer, so that T can be a pointer of protobuf msg
+	var target any = &data
+	if t := reflect.TypeOf(data); t != nil && t.Kind() == reflect.Pointer {
+		data = reflect.New(t.Elem()).Interface().(T)
+		target = data
+	}
+	codec := m.codec
+	if codec == nil {
+		// msg is created locally rather than decoded
+		codec = JSONCodec
+	}
+	var err error
+	if decoder, ok := codec.(DataDecoder); ok {
+		err = decoder.DecodeData(m.Data, target)
+	} else {
+		err = ParseFromMsg(m, target)
+	}
+	if err != nil {
+		var zero T
+		return zero, &DecodeError{Type: reflect.TypeOf(&data).Elem(), Err: err}
+	}
+	return data, nil
+}
@@ -25,14 +25,12 @@ import (
 // }
 
 func uniq(msg *core.Msg) string {
-	var data int
-	if err := core.ParseFromMsg(msg, &data); err == nil {
-		return fmt.Sprintf("%d", data)
-	} else {
+	data, err := core.DecodeData[int](msg)
+	if err != nil {
 		fmt.Println("uniq err:", err)
+		return ""
 	}
-
-	return ""
+	return fmt.Sprintf("%d", data)
 }
 
 func main() {
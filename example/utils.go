@@ -94,6 +94,16 @@ func (l *MyConsumerListener) OnConsumeFail(ctx context.Context, topic string, ms
 	fmt.Printf("failed to consume msg %s from %s, %s,ip: %s \n", msg.Id, topic, err.Error(), ip)
 }
 
+func (l *MyConsumerListener) OnExpired(ctx context.Context, topic string, msg *core.Msg) {
+	ip := ctx.Value("myip").(string)
+	fmt.Printf("msg %s from %s expired at %s,ip: %s \n", msg.Id, topic, msg.ExpireAt, ip)
+}
+
+func (l *MyConsumerListener) OnDecodeFail(ctx context.Context, topic string, msg *core.Msg, err *core.DecodeError) {
+	ip := ctx.Value("myip").(string)
+	fmt.Printf("failed to decode msg %s from %s, %s,ip: %s \n", msg.Id, topic, err.Error(), ip)
+}
+
 // MyIdCreator is a customized id creator
 type MyIdCreator struct{}
 
@@ -2,43 +2,466 @@ package windy
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/Visforest/goset/v2"
 	"github.com/segmentio/kafka-go"
-	"github.com/segmentio/kafka-go/sasl/plain"
 	"github.com/visforest/windy/core"
-	"os"
+	"math"
+	"sort"
 	"time"
 )
 
+// the default delay levels in seconds, a delay msg is relayed level by level until it's ready
+var defaultDelayLevels = []int{1, 5, 10, 30, 60, 300, 600, 1800, 3600, 7200}
+
 type kClient struct {
-	ctx    context.Context
-	conn   *kafka.Conn
-	writer *kafka.Writer
-	reader *kafka.Reader
+	ctx          context.Context
+	topic        string
+	conn         *kafka.Conn
+	writer       *kafka.Writer
+	reader       *kafka.Reader
+	offsets      *kOffsets                    // offsets of msgs fetched, unless offsets are committed manually
+	delayLevels  []time.Duration              // sorted ascending
+	delayReaders []*kafka.Reader              // delayReaders[i] reads topic of delayLevels[i]
+	retryTopic   string                       // the topic of msgs retried by the group of consumer, only for consumer
+	retryReaders []*kafka.Reader              // retryReaders[i] reads retry topic of delayLevels[i]
+	deadLetter   string                       // the dead-letter topic of the group of consumer, it's empty if dead letters aren't kept
+	encoder      core.MsgEncoder              // the encoder with which msgs are encoded
+	decodeFailed func(m *core.Msg, err error) // reports msgs relayed by consumer which can't be decoded, only for consumer
+
+	// only for producer
+	brokers []string
+	dialer  *kafka.Dialer
+	replies *kReplyInbox
+}
+
+// deadLetterTopic returns the dead-letter topic of the msgs failed in group, such as '<topic>.<group>.dlq',
+// so that dead letters are redriven to the group that failed them only
+func deadLetterTopic(topic, group string) string {
+	return fmt.Sprintf("%s.%s.dlq", topic, group)
+}
+
+// delayTopic returns the internal topic name of a delay level
+func delayTopic(topic string, level time.Duration) string {
+	return fmt.Sprintf("%s.delay.%ds", topic, int(level.Seconds()))
+}
+
+// retryTopic returns the topic of msgs retried by group, msgs failed in a group are retried in it only.
+// Msgs to retry are relayed through the delay topics of it, such as '<topic>.<group>.retry.delay.5s'.
+func retryTopic(topic, group string) string {
+	return fmt.Sprintf("%s.%s.retry", topic, group)
+}
+
+// getDelayLevels returns sorted delay levels from configuration
+func getDelayLevels(cfg *KConf) []time.Duration {
+	seconds := cfg.DelayLevels
+	if len(seconds) == 0 {
+		seconds = defaultDelayLevels
+	}
+	levels := make([]time.Duration, 0, len(seconds))
+	for _, s := range seconds {
+		if s > 0 {
+			levels = append(levels, time.Duration(s)*time.Second)
+		}
+	}
+	sort.Slice(levels, func(i, j int) bool { return levels[i] < levels[j] })
+	return levels
+}
+
+// topicFor returns the topic that msg should be sent to.
+// A delay msg is sent to the topic of the largest delay level that is not longer than the time remaining,
+// or the smallest one if the time remaining is shorter than any level.
+func (c *kClient) topicFor(m *core.Msg) string {
+	return c.delayTopicFor(c.topic, m)
+}
+
+// delayTopicFor returns topic or one of its delay topics that msg should be sent to
+func (c *kClient) delayTopicFor(topic string, m *core.Msg) string {
+	if m.DelayAt == nil || len(c.delayLevels) == 0 {
+		return topic
+	}
+	remaining := time.Until(*m.DelayAt)
+	if remaining <= 0 {
+		return topic
+	}
+	level := c.delayLevels[0]
+	for _, l := range c.delayLevels {
+		if l > remaining {
+			break
+		}
+		level = l
+	}
+	return delayTopic(topic, level)
 }
 
 func (c *kClient) Push(m *core.Msg) error {
-	val, err := json.Marshal(m)
+	message, err := c.encode(m)
+	if err != nil {
+		return err
+	}
+	return c.writer.WriteMessages(c.ctx, message)
+}
+
+// Retry sends msg to the retry topic of the group of consumer, through its delay topics, so that other groups don't get it again
+func (c *kClient) Retry(m *core.Msg) error {
+	if c.retryTopic == "" {
+		return errors.New("retry topics of group are missing, create them or set AutoCreateTopic")
+	}
+	message, err := c.encode(m)
 	if err != nil {
 		return err
 	}
-	return c.writer.WriteMessages(c.ctx, kafka.Message{Key: []byte(m.Id), Value: val})
+	message.Topic = c.delayTopicFor(c.retryTopic, m)
+	return c.writer.WriteMessages(c.ctx, message)
+}
+
+// PushBatch writes msgs by a WriteMessages
+func (c *kClient) PushBatch(ms []*core.Msg) []error {
+	errs := make([]error, len(ms))
+	var indexes []int // indexes of msgs encoded
+	var messages []kafka.Message
+	for i, m := range ms {
+		message, err := c.encode(m)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		indexes = append(indexes, i)
+		messages = append(messages, message)
+	}
+	if len(messages) > 0 {
+		err := c.writer.WriteMessages(c.ctx, messages...)
+		var writeErrs kafka.WriteErrors
+		if errors.As(err, &writeErrs) {
+			for j, i := range indexes {
+				errs[i] = writeErrs[j]
+			}
+		} else {
+			setErrs(errs, indexes, err)
+		}
+	}
+	return batchErrs(errs)
+}
+
+// encode encodes msg into a kafka message, headers of msg are mapped to kafka record headers
+func (c *kClient) encode(m *core.Msg) (kafka.Message, error) {
+	body := *m
+	body.Headers = nil
+	val, err := c.encoder.Encode(&body)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	message := kafka.Message{Topic: c.topicFor(m), Key: []byte(m.Id), Value: val}
+	for k, v := range m.Headers {
+		message.Headers = append(message.Headers, kafka.Header{Key: k, Value: []byte(v)})
+	}
+	return message, nil
+}
+
+// decodeKMsg decodes msg from a kafka message, kafka record headers are mapped to headers of msg
+func decodeKMsg(message kafka.Message) (*core.Msg, error) {
+	m, err := core.DecodeMsgFromBytes(message.Value)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range message.Headers {
+		m.SetHeader(h.Key, string(h.Value))
+	}
+	return m, nil
 }
 
-func (c *kClient) Fetch() (*core.Msg, error) {
-	message, err := c.reader.FetchMessage(c.ctx)
+func (c *kClient) Fetch(ctx context.Context) (*core.Msg, error) {
+	message, err := c.fetchMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m, err := decodeKMsg(message)
 	if err != nil {
+		// bad msg will never be consumed successfully, skip it
+		if c.deadLetter != "" {
+			if dlErr := c.pushDeadLetter(core.NewDeadLetter(nil, message.Value, err)); dlErr != nil {
+				fmt.Println("dead letter err:", dlErr)
+			}
+		}
+		if c.offsets != nil {
+			_ = c.offsets.ack(message, c.commitMessage)
+		}
 		return nil, err
 	}
-	return core.DecodeMsgFromBytes(message.Value)
+	m.SetAckToken(message)
+	return m, nil
+}
+
+// fetchMessage returns the nacked msg if it's due to be delivered again, otherwise fetches the next msg.
+// Fetching waits while too many offsets are pending, until some of them are committed or a nacked msg is due.
+func (c *kClient) fetchMessage(ctx context.Context) (kafka.Message, error) {
+	if c.offsets == nil {
+		return c.reader.FetchMessage(ctx)
+	}
+	for {
+		message, wait, ok := c.offsets.redelivery()
+		if ok {
+			return message, nil
+		}
+		fetchCtx, cancel := ctx, context.CancelFunc(func() {})
+		if wait > 0 {
+			fetchCtx, cancel = context.WithTimeout(ctx, wait)
+		}
+		message, err := c.fetchNewMessage(fetchCtx)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			// a nacked msg is due
+			continue
+		}
+		return message, err
+	}
+}
+
+// fetchNewMessage fetches the next msg from reader and records its offset
+func (c *kClient) fetchNewMessage(ctx context.Context) (kafka.Message, error) {
+	if err := c.offsets.acquire(ctx); err != nil {
+		return kafka.Message{}, err
+	}
+	message, err := c.reader.FetchMessage(ctx)
+	// partitions may be revoked by a rebalance, msgs of the new generation are fetched after it's counted
+	if c.reader.Stats().Rebalances > 0 {
+		c.offsets.rebalanced()
+	}
+	if err != nil {
+		c.offsets.release(1)
+		return kafka.Message{}, err
+	}
+	c.offsets.fetched(message)
+	return message, nil
+}
+
+// DeadLetter sends msg to dead-letter topic if enabled
+func (c *kClient) DeadLetter(m *core.Msg, reason error) (bool, error) {
+	if c.deadLetter == "" {
+		return false, nil
+	}
+	var payload []byte
+	if message, ok := m.AckToken().(kafka.Message); ok {
+		payload = message.Value
+	} else {
+		message, err := c.encode(m)
+		if err != nil {
+			return false, err
+		}
+		payload = message.Value
+	}
+	if err := c.pushDeadLetter(core.NewDeadLetter(m, payload, reason)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (c *kClient) pushDeadLetter(d *core.DeadLetter) error {
+	val, err := d.Encode()
+	if err != nil {
+		return err
+	}
+	return c.writer.WriteMessages(c.ctx, kafka.Message{Topic: c.deadLetter, Key: []byte(d.Id), Value: val})
+}
+
+// Ack commits the offset below which all the msgs of the partition are acknowledged, unless offsets are committed manually
+func (c *kClient) Ack(m *core.Msg) error {
+	if c.offsets == nil {
+		return nil
+	}
+	message, ok := m.AckToken().(kafka.Message)
+	if !ok {
+		return nil
+	}
+	return c.offsets.ack(message, c.commitMessage)
+}
+
+// Nack delivers msg again after a while, offsets of its partition aren't committed past it until it's acknowledged
+func (c *kClient) Nack(m *core.Msg, err error) error {
+	if c.offsets == nil {
+		return nil
+	}
+	if message, ok := m.AckToken().(kafka.Message); ok {
+		c.offsets.nack(message)
+	}
+	return nil
+}
+
+func (c *kClient) commitMessage(message kafka.Message) error {
+	return c.reader.CommitMessages(c.ctx, message)
+}
+
+// commit commits offsets of msgs, in periodic commit strategy, offsets are committed asynchronously
+func (c *kClient) commit(msgs ...*core.Msg) error {
+	messages := make([]kafka.Message, 0, len(msgs))
+	for _, m := range msgs {
+		if message, ok := m.AckToken().(kafka.Message); ok {
+			messages = append(messages, message)
+		}
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	return c.reader.CommitMessages(c.ctx, messages...)
+}
+
+// relayDelayMsgs reads msgs of a delay level of topic in loop, holds each of them until the level passed,
+// then sends it to topic if it's ready, otherwise to the next delay level.
+// Since msgs of a level are held for the same duration, they get ready in the order they were read.
+// It quits when ctx is done.
+func (c *kClient) relayDelayMsgs(ctx context.Context, reader *kafka.Reader, topic string, level time.Duration) {
+	for {
+		message, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			fmt.Println("relayDelayMsgs err:", err)
+			continue
+		}
+		m, err := core.DecodeMsgFromBytes(message.Value)
+		if err != nil {
+			// bad msg will never be relayed, keep it in dead-letter topic if enabled
+			bad := &core.Msg{Id: string(message.Key)}
+			if c.decodeFailed != nil {
+				c.decodeFailed(bad, err)
+			}
+			if c.deadLetter != "" {
+				val, dlErr := core.NewDeadLetter(bad, message.Value, err).Encode()
+				if dlErr != nil {
+					fmt.Println("relayDelayMsgs err:", dlErr)
+				} else if !c.writeUntilSent(ctx, kafka.Message{Topic: c.deadLetter, Key: message.Key, Value: val}) {
+					return
+				}
+			}
+			if err = reader.CommitMessages(c.ctx, message); err != nil {
+				fmt.Println("relayDelayMsgs err:", err)
+			}
+			continue
+		}
+		wait := message.Time.Add(level)
+		if m.DelayAt != nil && m.DelayAt.Before(wait) {
+			wait = *m.DelayAt
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(wait)):
+		}
+		// relay raw msg
+		relay := kafka.Message{Topic: c.delayTopicFor(topic, m), Key: message.Key, Value: message.Value, Headers: message.Headers}
+		if !c.writeUntilSent(ctx, relay) {
+			return
+		}
+		if err = reader.CommitMessages(c.ctx, message); err != nil {
+			fmt.Println("relayDelayMsgs err:", err)
+		}
+	}
+}
+
+// writeUntilSent writes message until it succeeds so that it won't be lost, it returns false if ctx is done before that
+func (c *kClient) writeUntilSent(ctx context.Context, message kafka.Message) bool {
+	for {
+		err := c.writer.WriteMessages(ctx, message)
+		if err == nil {
+			return true
+		}
+		fmt.Println("relayDelayMsgs err:", err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// startDelayRelays relays delay msgs and msgs to retry of all delay levels until ctx is done
+func (c *kClient) startDelayRelays(ctx context.Context) {
+	for i, reader := range c.delayReaders {
+		go c.relayDelayMsgs(ctx, reader, c.topic, c.delayLevels[i])
+	}
+	for i, reader := range c.retryReaders {
+		go c.relayDelayMsgs(ctx, reader, c.retryTopic, c.delayLevels[i])
+	}
+}
+
+// close closes all the connections, the offsets not committed in periodic commit strategy are committed
+func (c *kClient) close() error {
+	errs := []error{c.closeReplyInbox()}
+	if c.reader != nil {
+		errs = append(errs, c.reader.Close())
+	}
+	for _, reader := range c.delayReaders {
+		errs = append(errs, reader.Close())
+	}
+	for _, reader := range c.retryReaders {
+		errs = append(errs, reader.Close())
+	}
+	if c.writer != nil {
+		errs = append(errs, c.writer.Close())
+	}
+	errs = append(errs, c.conn.Close())
+	return errors.Join(errs...)
+}
+
+// createTopics creates the main topic and the delay topics if missing, and the retry topics and dead-letter topic of group if it's set
+func createTopics(conn *kafka.Conn, cfg *KConf) error {
+	// although writer can create topic if missing, but partitions count and replications count are important for efficiency,
+	// but writer doesn't ensure that
+	topics := []kafka.TopicConfig{{
+		Topic:             cfg.Topic,
+		NumPartitions:     cfg.Kafka.Partitions,
+		ReplicationFactor: cfg.Kafka.Replications,
+	}}
+	for _, level := range getDelayLevels(cfg) {
+		topics = append(topics, kafka.TopicConfig{
+			Topic:             delayTopic(cfg.Topic, level),
+			NumPartitions:     cfg.Kafka.Partitions,
+			ReplicationFactor: cfg.Kafka.Replications,
+		})
+	}
+	if cfg.Kafka.Group != "" {
+		retry := retryTopic(cfg.Topic, cfg.Kafka.Group)
+		topics = append(topics, kafka.TopicConfig{
+			Topic:             retry,
+			NumPartitions:     cfg.Kafka.Partitions,
+			ReplicationFactor: cfg.Kafka.Replications,
+		})
+		for _, level := range getDelayLevels(cfg) {
+			topics = append(topics, kafka.TopicConfig{
+				Topic:             delayTopic(retry, level),
+				NumPartitions:     cfg.Kafka.Partitions,
+				ReplicationFactor: cfg.Kafka.Replications,
+			})
+		}
+		if cfg.DeadLetter {
+			topics = append(topics, kafka.TopicConfig{
+				Topic:             deadLetterTopic(cfg.Topic, cfg.Kafka.Group),
+				NumPartitions:     cfg.Kafka.Partitions,
+				ReplicationFactor: cfg.Kafka.Replications,
+			})
+		}
+	}
+	if cfg.Reply {
+		topics = append(topics, kafka.TopicConfig{
+			Topic:             replyTopic(cfg.Topic),
+			NumPartitions:     cfg.Kafka.Partitions,
+			ReplicationFactor: cfg.Kafka.Replications,
+		})
+	}
+	return conn.CreateTopics(topics...)
 }
 
-func (c *kClient) FetchDelayMsgs() ([]*core.Msg, error) {
-	panic("not supported")
+// newKWriter returns a writer which writes msgs to the topics specified by msgs
+func newKWriter(cfg *KConf, security *kafkaSecurity) *kafka.Writer {
+	return &kafka.Writer{
+		Addr:                   kafka.TCP(cfg.Kafka.Brokers...),
+		Transport:              security.transport(),
+		AllowAutoTopicCreation: cfg.Kafka.AutoCreateTopic,
+		Balancer:               &kafka.LeastBytes{},
+		Compression:            kafka.Snappy,
+	}
 }
 
 type KProducer struct {
@@ -48,42 +471,41 @@ type KProducer struct {
 
 // NewKProducer returns a producer and an error
 func NewKProducer(cfg *KConf, opts ...core.ProducerOption) (*KProducer, error) {
-	conn, err := kafka.Dial("tcp", cfg.Kafka.Brokers[0])
+	security, err := newKafkaSecurity(cfg.Kafka)
 	if err != nil {
 		return nil, err
 	}
-	writer := &kafka.Writer{
-		Addr:                   kafka.TCP(cfg.Kafka.Brokers...),
-		Topic:                  cfg.Topic,
-		AllowAutoTopicCreation: cfg.Kafka.AutoCreateTopic,
-		Balancer:               &kafka.LeastBytes{},
-		Compression:            kafka.Snappy,
+	dialer := security.dialer()
+	conn, err := dialer.Dial("tcp", cfg.Kafka.Brokers[0])
+	if err != nil {
+		return nil, err
 	}
+	writer := newKWriter(cfg, security)
 	if cfg.Kafka.AutoCreateTopic {
-		// although writer can create topic if missing, but partitions count and replications count are important for efficiency,
-		// but writer doesn't ensure that
-		err = conn.CreateTopics(kafka.TopicConfig{
-			Topic:             cfg.Topic,
-			NumPartitions:     cfg.Kafka.Partitions,
-			ReplicationFactor: cfg.Kafka.Replications,
-		})
-		if err != nil {
+		if err = createTopics(conn, cfg); err != nil {
+			_ = conn.Close()
 			return nil, err
 		}
 	}
 	producerCore := &core.ProducerCore{
 		Ctx:       context.Background(),
 		Topic:     cfg.Topic,
-		IdCreator: core.NewSnowflakeCreator(1),
+		IdCreator: core.DefaultIdCreator,
 	}
 	for _, opt := range opts {
 		opt(producerCore)
 	}
 	client := &kClient{
-		ctx:    producerCore.Ctx,
-		conn:   conn,
-		writer: writer,
-		reader: nil,
+		ctx:         producerCore.Ctx,
+		topic:       cfg.Topic,
+		conn:        conn,
+		writer:      writer,
+		reader:      nil,
+		delayLevels: getDelayLevels(cfg),
+		encoder:     producerCore.MsgEncoder(),
+		brokers:     cfg.Kafka.Brokers,
+		dialer:      dialer,
+		replies:     &kReplyInbox{waiters: make(map[string]chan *core.Msg)},
 	}
 	return &KProducer{
 		producerCore: producerCore,
@@ -105,9 +527,45 @@ func (p *KProducer) Send(data any, opts ...core.MsgOption) (string, error) {
 	return p.producerCore.Send(p.client, core.NewMsg(data, opts...))
 }
 
+// SendMsg sends msg as it is, msg id is kept if it's set
+func (p *KProducer) SendMsg(m *core.Msg) (string, error) {
+	return p.producerCore.Send(p.client, m)
+}
+
+// Request sends data as a request, and blocks until its reply is received or ctx is done
+func (p *KProducer) Request(ctx context.Context, data any, opts ...core.MsgOption) (*core.Msg, error) {
+	return p.producerCore.Request(ctx, p.client, p.client, core.NewMsg(data, opts...))
+}
+
+// SendBatch sends data items to message queue by a WriteMessages, ids are returned in order, and the id of item failed to be sent is empty.
+// If some items are failed to be sent, a *core.BatchError is returned.
+func (p *KProducer) SendBatch(items []any, opts ...core.MsgOption) ([]string, error) {
+	return p.producerCore.SendBatch(p.client, core.NewMsgs(items, opts...))
+}
+
+// SendAsync buffers data and returns msg id, msg is sent in background and the result is reported by listener.
+// It blocks if the buffer is full, and returns core.ErrProducerClosed after producer is closed.
+func (p *KProducer) SendAsync(data any, opts ...core.MsgOption) (string, error) {
+	return p.producerCore.SendAsync(p.client, core.NewMsg(data, opts...))
+}
+
+// Flush blocks until the msgs buffered by SendAsync before are sent or ctx is done
+func (p *KProducer) Flush(ctx context.Context) error {
+	return p.producerCore.Flush(ctx)
+}
+
+// Close sends all the msgs buffered by SendAsync, and then closes the connections.
+// If ctx is done earlier, the buffered msgs are still sent in background and the connections are closed after that.
+func (p *KProducer) Close(ctx context.Context) error {
+	return p.producerCore.Close(ctx, p.client.close)
+}
+
 type KConsumer struct {
 	consumerCore *core.ConsumerCore
 	client       *kClient
+	readerConfig kafka.ReaderConfig
+	admin        *kafka.Client // reads and commits offsets of dead letters
+	stop         context.CancelFunc
 }
 
 // NewKConsumer returns a consumer and error
@@ -120,37 +578,36 @@ func NewKConsumer(cfg *KConf, ConsumeFunc core.ConsumeFunc, opts ...core.Consume
 		MaxBytes:    cfg.Kafka.MaxBytes,
 		StartOffset: kafka.FirstOffset,
 	}
-	if len(cfg.Kafka.Username) > 0 && len(cfg.Kafka.Password) > 0 {
-		readerConfig.Dialer = &kafka.Dialer{
-			SASLMechanism: plain.Mechanism{
-				Username: cfg.Kafka.Username,
-				Password: cfg.Kafka.Password,
-			},
+	switch cfg.Kafka.CommitStrategy {
+	case "", CommitPerMessage, CommitManual:
+	case CommitPeriodic:
+		commitInterval := cfg.Kafka.CommitInterval
+		if commitInterval <= 0 {
+			commitInterval = 1
 		}
+		readerConfig.CommitInterval = time.Duration(commitInterval) * time.Second
+	default:
+		return nil, fmt.Errorf("unsupported commit strategy '%s'", cfg.Kafka.CommitStrategy)
 	}
-	if len(cfg.Kafka.CaFile) > 0 {
-		caCert, err := os.ReadFile(cfg.Kafka.CaFile)
-		if err != nil {
-			return nil, err
-		}
-
-		caCertPool := x509.NewCertPool()
-		if ok := caCertPool.AppendCertsFromPEM(caCert); !ok {
-			return nil, errors.New("certificate file is invalid")
-		}
-
-		readerConfig.Dialer.TLS = &tls.Config{
-			RootCAs:            caCertPool,
-			InsecureSkipVerify: true,
-		}
+	security, err := newKafkaSecurity(cfg.Kafka)
+	if err != nil {
+		return nil, err
 	}
+	readerConfig.Dialer = security.dialer()
 	// connect and get partitions count
-	conn, err := kafka.Dial("tcp", cfg.Kafka.Brokers[0])
+	conn, err := readerConfig.Dialer.Dial("tcp", cfg.Kafka.Brokers[0])
 	if err != nil {
 		return nil, err
 	}
+	if cfg.Kafka.AutoCreateTopic {
+		if err = createTopics(conn, cfg); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
 	partitions, err := conn.ReadPartitions(cfg.Topic)
 	if err != nil {
+		_ = conn.Close()
 		return nil, err
 	}
 	if cfg.Workers <= 0 {
@@ -159,7 +616,39 @@ func NewKConsumer(cfg *KConf, ConsumeFunc core.ConsumeFunc, opts ...core.Consume
 	} else if cfg.Workers < len(partitions) {
 		// warning, it's not the best practice
 	}
-	reader := kafka.NewReader(readerConfig)
+	// the group reads msgs of topic and the ones retried by itself, if the retry topic exists
+	retry := retryTopic(cfg.Topic, cfg.Kafka.Group)
+	groupReaderConfig := readerConfig
+	if retryPartitions, err := conn.ReadPartitions(retry); err == nil && len(retryPartitions) > 0 {
+		groupReaderConfig.Topic = ""
+		groupReaderConfig.GroupTopics = []string{cfg.Topic, retry}
+	} else {
+		retry = ""
+	}
+	reader := kafka.NewReader(groupReaderConfig)
+	// delay topics are shared by all the groups of topic, delay msgs are relayed by a group depending only on topic,
+	// so that each of them is relayed once by one of all the consumers
+	delayLevels := getDelayLevels(cfg)
+	delayReaders := make([]*kafka.Reader, len(delayLevels))
+	for i, level := range delayLevels {
+		delayReaderConfig := readerConfig
+		delayReaderConfig.Topic = delayTopic(cfg.Topic, level)
+		delayReaderConfig.GroupID = delayTopic(cfg.Topic, level)
+		delayReaderConfig.CommitInterval = 0
+		delayReaders[i] = kafka.NewReader(delayReaderConfig)
+	}
+	// msgs to retry are relayed by consumers of the group
+	var retryReaders []*kafka.Reader
+	if retry != "" {
+		retryReaders = make([]*kafka.Reader, len(delayLevels))
+		for i, level := range delayLevels {
+			retryReaderConfig := readerConfig
+			retryReaderConfig.Topic = delayTopic(retry, level)
+			retryReaderConfig.GroupID = delayTopic(retry, level)
+			retryReaderConfig.CommitInterval = 0
+			retryReaders[i] = kafka.NewReader(retryReaderConfig)
+		}
+	}
 	var batchProcess *BatchProcessConf
 	if cfg.BatchProcess == nil {
 		batchProcess = &BatchProcessConf{}
@@ -179,15 +668,34 @@ func NewKConsumer(cfg *KConf, ConsumeFunc core.ConsumeFunc, opts ...core.Consume
 		opt(consumerCore)
 	}
 
+	var deadLetter string
+	if cfg.DeadLetter {
+		deadLetter = deadLetterTopic(cfg.Topic, cfg.Kafka.Group)
+	}
+	var offsets *kOffsets
+	if cfg.Kafka.CommitStrategy != CommitManual {
+		offsets = newKOffsets(maxPendingOffsets, nackRedeliveryDelay)
+	}
 	client := &kClient{
-		ctx:    consumerCore.Ctx,
-		conn:   conn,
-		writer: nil,
-		reader: reader,
+		ctx:          consumerCore.Ctx,
+		topic:        cfg.Topic,
+		conn:         conn,
+		writer:       newKWriter(cfg, security),
+		reader:       reader,
+		delayLevels:  delayLevels,
+		delayReaders: delayReaders,
+		retryTopic:   retry,
+		retryReaders: retryReaders,
+		offsets:      offsets,
+		deadLetter:   deadLetter,
+		encoder:      consumerCore.MsgEncoder(),
+		decodeFailed: consumerCore.ReportDecodeFail,
 	}
 	return &KConsumer{
 		consumerCore: consumerCore,
 		client:       client,
+		readerConfig: readerConfig,
+		admin:        &kafka.Client{Addr: kafka.TCP(cfg.Kafka.Brokers...), Transport: security.transport()},
 	}, nil
 }
 
@@ -200,7 +708,237 @@ func MustNewKConsumer(cfg *KConf, ConsumeFunc core.ConsumeFunc, opts ...core.Con
 	return consumer
 }
 
-// LoopConsume blocks and consumes msgs in loop with multi goroutine
+// LoopConsume blocks and consumes msgs in loop with multi goroutine, until it gets a quit signal
 func (c *KConsumer) LoopConsume() {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	c.client.startDelayRelays(ctx)
 	c.consumerCore.LoopConsume(c.client)
 }
+
+// Start starts to consume msgs in background, msgs are fetched until ctx is done or Shutdown is called
+func (c *KConsumer) Start(ctx context.Context) error {
+	ctx, stop := context.WithCancel(ctx)
+	if err := c.consumerCore.Start(ctx, c.client); err != nil {
+		stop()
+		return err
+	}
+	// kept only if started, so that starting twice doesn't lose the stop of the running one
+	c.stop = stop
+	c.client.startDelayRelays(ctx)
+	return nil
+}
+
+// Shutdown stops fetching msgs, waits until the fetched ones are consumed and committed or ctx is done,
+// and then closes the connections.
+func (c *KConsumer) Shutdown(ctx context.Context) error {
+	err := c.consumerCore.Shutdown(ctx)
+	if c.stop != nil {
+		c.stop()
+	}
+	return errors.Join(err, c.client.close())
+}
+
+// Commit commits offsets of msgs, it's used in manual commit strategy.
+// Kafka commits the offset of a partition rather than msgs, the msgs before the ones committed are skipped after restart
+// even if they haven't been consumed, so it's at-most-once unless msgs are committed in order.
+func (c *KConsumer) Commit(msgs ...*core.Msg) error {
+	return c.client.commit(msgs...)
+}
+
+// kOffsetRange is the offsets [first, last) of msgs in a partition
+type kOffsetRange struct {
+	partition   int
+	first, last int64
+}
+
+// deadLetterRanges returns the offsets of the dead letters in each partition which haven't been skipped or redriven,
+// they start from the offsets committed by group '<dead-letter topic>' and end at the last offsets by the time it's called,
+// so that the dead letters read are certain even if more ones are written meanwhile.
+func (c *KConsumer) deadLetterRanges(ctx context.Context) ([]kOffsetRange, error) {
+	if c.client.deadLetter == "" {
+		return nil, errors.New("dead letters aren't kept, set DeadLetter to keep them")
+	}
+	topic := c.client.deadLetter
+	partitions, err := c.client.conn.ReadPartitions(topic)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, len(partitions))
+	requests := make([]kafka.OffsetRequest, 0, 2*len(partitions))
+	for i, p := range partitions {
+		ids[i] = p.ID
+		requests = append(requests, kafka.FirstOffsetOf(p.ID), kafka.LastOffsetOf(p.ID))
+	}
+	listed, err := c.admin.ListOffsets(ctx, &kafka.ListOffsetsRequest{Topics: map[string][]kafka.OffsetRequest{topic: requests}})
+	if err != nil {
+		return nil, err
+	}
+	fetched, err := c.admin.OffsetFetch(ctx, &kafka.OffsetFetchRequest{GroupID: topic, Topics: map[string][]int{topic: ids}})
+	if err != nil {
+		return nil, err
+	}
+	if fetched.Error != nil {
+		return nil, fetched.Error
+	}
+	committed := make(map[int]int64, len(ids))
+	for _, p := range fetched.Topics[topic] {
+		if p.Error != nil {
+			return nil, p.Error
+		}
+		committed[p.Partition] = p.CommittedOffset
+	}
+	ranges := make([]kOffsetRange, 0, len(ids))
+	for _, p := range listed.Topics[topic] {
+		if p.Error != nil {
+			return nil, p.Error
+		}
+		// the committed offset is -1 if nothing is committed, or it may be removed by retention already
+		first := p.FirstOffset
+		if offset, ok := committed[p.Partition]; ok && offset > first {
+			first = offset
+		}
+		if first < p.LastOffset {
+			ranges = append(ranges, kOffsetRange{partition: p.Partition, first: first, last: p.LastOffset})
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].partition < ranges[j].partition
+	})
+	return ranges, nil
+}
+
+// commitDeadLetters commits offsets by group '<dead-letter topic>', the dead letters before them won't be read again
+func (c *KConsumer) commitDeadLetters(ctx context.Context, commits []kafka.OffsetCommit) error {
+	topic := c.client.deadLetter
+	resp, err := c.admin.OffsetCommit(ctx, &kafka.OffsetCommitRequest{
+		GroupID: topic,
+		// offsets are committed without joining the group
+		GenerationID: -1,
+		Topics:       map[string][]kafka.OffsetCommit{topic: commits},
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range resp.Topics[topic] {
+		if p.Error != nil {
+			return p.Error
+		}
+	}
+	return nil
+}
+
+// readDeadLetters reads at most n dead letters partition by partition and handles them, the earliest first in each partition.
+// If commit is true, the handled ones are committed and won't be read again. It returns the count of handled dead letters.
+func (c *KConsumer) readDeadLetters(n int64, commit bool, handle func(d *core.DeadLetter) error) (int64, error) {
+	ctx := c.client.ctx
+	ranges, err := c.deadLetterRanges(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var handled int64
+	for _, r := range ranges {
+		if handled >= n {
+			break
+		}
+		count, next, err := c.readDeadLetterRange(ctx, r, n-handled, handle)
+		handled += count
+		if commit && next > r.first {
+			err = errors.Join(err, c.commitDeadLetters(ctx, []kafka.OffsetCommit{{Partition: r.partition, Offset: next}}))
+		}
+		if err != nil {
+			return handled, err
+		}
+	}
+	return handled, nil
+}
+
+// readDeadLetterRange reads at most n dead letters in r by a partition reader and handles them,
+// it returns the count of handled dead letters and the offset after the last handled one.
+func (c *KConsumer) readDeadLetterRange(ctx context.Context, r kOffsetRange, n int64, handle func(d *core.DeadLetter) error) (int64, int64, error) {
+	readerConfig := c.readerConfig
+	readerConfig.Topic = c.client.deadLetter
+	readerConfig.GroupID = ""
+	readerConfig.Partition = r.partition
+	readerConfig.CommitInterval = 0
+	reader := kafka.NewReader(readerConfig)
+	defer reader.Close()
+	if err := reader.SetOffset(r.first); err != nil {
+		return 0, r.first, err
+	}
+
+	var handled int64
+	next := r.first
+	for handled < n && next < r.last {
+		message, err := reader.ReadMessage(ctx)
+		if err != nil {
+			return handled, next, err
+		}
+		if message.Offset >= r.last {
+			break
+		}
+		d, err := core.DecodeDeadLetter(message.Value)
+		if err == nil {
+			err = handle(d)
+		}
+		if err != nil {
+			return handled, next, err
+		}
+		handled++
+		next = message.Offset + 1
+	}
+	return handled, next, nil
+}
+
+// DeadLetters returns at most limit dead letters, the earliest first in each partition
+func (c *KConsumer) DeadLetters(limit int64) ([]*core.DeadLetter, error) {
+	var letters []*core.DeadLetter
+	_, err := c.readDeadLetters(limit, false, func(d *core.DeadLetter) error {
+		letters = append(letters, d)
+		return nil
+	})
+	return letters, err
+}
+
+// DeadLetter returns the dead letter of msg id, or nil if it's missing
+func (c *KConsumer) DeadLetter(id string) (*core.DeadLetter, error) {
+	var letter *core.DeadLetter
+	_, err := c.readDeadLetters(math.MaxInt64, false, func(d *core.DeadLetter) error {
+		if letter == nil && d.Id == id {
+			letter = d
+		}
+		return nil
+	})
+	return letter, err
+}
+
+// SkipDeadLetters skips all the dead letters so that they're neither listed nor redriven any more, returns the count of
+// skipped ones. Kafka can't delete msgs of a topic, they're kept in the dead-letter topic until its retention.
+func (c *KConsumer) SkipDeadLetters() (int64, error) {
+	ranges, err := c.deadLetterRanges(c.client.ctx)
+	if err != nil || len(ranges) == 0 {
+		return 0, err
+	}
+	var skipped int64
+	commits := make([]kafka.OffsetCommit, len(ranges))
+	for i, r := range ranges {
+		commits[i] = kafka.OffsetCommit{Partition: r.partition, Offset: r.last}
+		skipped += r.last - r.first
+	}
+	if err = c.commitDeadLetters(c.client.ctx, commits); err != nil {
+		return 0, err
+	}
+	return skipped, nil
+}
+
+// RedriveDeadLetters sends at most n dead letters to the retry topic of group, so that they're consumed again by group only,
+// the earliest first in each partition. It returns the count of redriven ones.
+func (c *KConsumer) RedriveDeadLetters(n int64) (int64, error) {
+	return c.readDeadLetters(n, true, func(d *core.DeadLetter) error {
+		m, err := d.Msg()
+		if err != nil {
+			return err
+		}
+		return c.client.Retry(m)
+	})
+}
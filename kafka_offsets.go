@@ -0,0 +1,193 @@
+package windy
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// the max count of offsets fetched and not committed, fetching waits until some of them are committed when it's reached,
+	// so that the offsets acknowledged behind a msg which is never acknowledged don't pile up without bound
+	maxPendingOffsets = 10000
+	// the duration after which a nacked msg is delivered again
+	nackRedeliveryDelay = time.Second
+)
+
+// kOffsets tracks the offsets of msgs fetched from each partition, so that only the watermark, the highest offset
+// below which all the msgs are acknowledged, is committed. Msgs are consumed by workers concurrently, committing
+// the offset of a msg acknowledged earlier than the ones before it would skip them after restart.
+// Kafka can't redeliver a single msg, so nacked msgs are delivered again by consumer itself until they're acknowledged.
+type kOffsets struct {
+	mu              sync.Mutex
+	partitions      map[kPartition]*kPartitionOffsets
+	slots           chan struct{} // a slot is taken by each offset fetched and not committed
+	redeliveryDelay time.Duration
+	redeliveries    []kRedelivery // nacked msgs to deliver again, in the order they're due
+}
+
+// kPartition is a partition of a topic, msgs of many topics are fetched by the reader of consumer group
+type kPartition struct {
+	topic     string
+	partition int
+}
+
+type kPartitionOffsets struct {
+	pending []int64        // offsets fetched and not committed, ascending
+	acked   map[int64]bool // acknowledged offsets of pending
+	last    int64          // the offset fetched last
+	stale   bool           // a rebalance happened after partition was fetched from last, it may have been revoked
+}
+
+type kRedelivery struct {
+	message kafka.Message
+	at      time.Time
+}
+
+func newKOffsets(limit int, redeliveryDelay time.Duration) *kOffsets {
+	return &kOffsets{
+		partitions:      make(map[kPartition]*kPartitionOffsets),
+		slots:           make(chan struct{}, limit),
+		redeliveryDelay: redeliveryDelay,
+	}
+}
+
+// acquire takes a slot for the msg to fetch, it blocks until a slot is released or ctx is done
+func (o *kOffsets) acquire(ctx context.Context) error {
+	select {
+	case o.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release releases n slots
+func (o *kOffsets) release(n int) {
+	for i := 0; i < n; i++ {
+		<-o.slots
+	}
+}
+
+// fetched records the offset of message fetched with a slot taken
+func (o *kOffsets) fetched(message kafka.Message) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	key := kPartition{topic: message.Topic, partition: message.Partition}
+	p, ok := o.partitions[key]
+	if ok && message.Offset <= p.last {
+		// partition is read again from the committed offset after a rebalance, the msgs not committed are fetched again
+		o.drop(key)
+		ok = false
+	}
+	if !ok {
+		p = &kPartitionOffsets{acked: make(map[int64]bool)}
+		o.partitions[key] = p
+	}
+	// msgs of a partition are fetched in order
+	p.pending = append(p.pending, message.Offset)
+	p.last = message.Offset
+	p.stale = false
+}
+
+// rebalanced drops the partitions which haven't been fetched from since the rebalance before, they've been revoked,
+// and marks the others stale, offsets of them aren't committed until they're fetched from again,
+// since they may have been revoked and owned by another consumer now.
+func (o *kOffsets) rebalanced() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for key, p := range o.partitions {
+		if p.stale {
+			o.drop(key)
+		} else {
+			p.stale = true
+		}
+	}
+}
+
+// drop drops all the offsets of partition and its msgs to deliver again, with lock held
+func (o *kOffsets) drop(key kPartition) {
+	p, ok := o.partitions[key]
+	if !ok {
+		return
+	}
+	o.release(len(p.pending))
+	delete(o.partitions, key)
+	redeliveries := o.redeliveries[:0]
+	for _, r := range o.redeliveries {
+		if r.message.Topic != key.topic || r.message.Partition != key.partition {
+			redeliveries = append(redeliveries, r)
+		}
+	}
+	o.redeliveries = redeliveries
+}
+
+// pendingOf returns the offsets of partition if offset of message is pending in it
+func (o *kOffsets) pendingOf(message kafka.Message) (*kPartitionOffsets, bool) {
+	p, ok := o.partitions[kPartition{topic: message.Topic, partition: message.Partition}]
+	if !ok {
+		return nil, false
+	}
+	i := sort.Search(len(p.pending), func(i int) bool { return p.pending[i] >= message.Offset })
+	return p, i < len(p.pending) && p.pending[i] == message.Offset
+}
+
+// ack marks message acknowledged, and commits the watermark of its partition by commit if it advances.
+// Watermarks are committed in order since they're committed with lock held.
+// Msgs fetched before their partition is dropped or read again are ignored, they're delivered again if not committed.
+func (o *kOffsets) ack(message kafka.Message, commit func(message kafka.Message) error) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p, ok := o.pendingOf(message)
+	if !ok {
+		return nil
+	}
+	p.acked[message.Offset] = true
+	var n int
+	for n < len(p.pending) && p.acked[p.pending[n]] {
+		delete(p.acked, p.pending[n])
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	watermark := p.pending[n-1]
+	p.pending = p.pending[n:]
+	o.release(n)
+	if p.stale {
+		// the watermark is committed once partition is fetched from again
+		return nil
+	}
+	// only the position is needed to commit, don't keep the value
+	return commit(kafka.Message{Topic: message.Topic, Partition: message.Partition, Offset: watermark})
+}
+
+// nack schedules message to be delivered again after the redelivery delay,
+// the watermark of its partition stops before it until it's acknowledged
+func (o *kOffsets) nack(message kafka.Message) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if p, ok := o.pendingOf(message); !ok || p.acked[message.Offset] {
+		return
+	}
+	o.redeliveries = append(o.redeliveries, kRedelivery{message: message, at: time.Now().Add(o.redeliveryDelay)})
+}
+
+// redelivery returns the first nacked msg if it's due to be delivered again, otherwise the duration until it's due,
+// or 0 if there's none
+func (o *kOffsets) redelivery() (kafka.Message, time.Duration, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.redeliveries) == 0 {
+		return kafka.Message{}, 0, false
+	}
+	r := o.redeliveries[0]
+	if wait := time.Until(r.at); wait > 0 {
+		return kafka.Message{}, wait, false
+	}
+	o.redeliveries = o.redeliveries[1:]
+	return r.message, 0, true
+}
@@ -0,0 +1,186 @@
+package windy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// committer records the offsets committed
+type committer struct {
+	offsets []int64
+}
+
+func (c *committer) commit(message kafka.Message) error {
+	c.offsets = append(c.offsets, message.Offset)
+	return nil
+}
+
+func (c *committer) last() int64 {
+	if len(c.offsets) == 0 {
+		return -1
+	}
+	return c.offsets[len(c.offsets)-1]
+}
+
+func kMessage(partition int, offset int64) kafka.Message {
+	return kafka.Message{Topic: "test", Partition: partition, Offset: offset}
+}
+
+// fetchAll takes slots and records offsets as if they're fetched
+func fetchAll(t *testing.T, o *kOffsets, messages ...kafka.Message) {
+	t.Helper()
+	for _, message := range messages {
+		if err := o.acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		o.fetched(message)
+	}
+}
+
+func TestKOffsetsWatermark(t *testing.T) {
+	o := newKOffsets(10, time.Second)
+	c := &committer{}
+	fetchAll(t, o, kMessage(0, 1), kMessage(0, 2), kMessage(0, 3), kMessage(1, 7))
+
+	// acked out of order, the watermark waits for the msgs before
+	if err := o.ack(kMessage(0, 3), c.commit); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.ack(kMessage(0, 2), c.commit); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.offsets) != 0 {
+		t.Fatalf("expect nothing committed, got %v", c.offsets)
+	}
+	if err := o.ack(kMessage(0, 1), c.commit); err != nil {
+		t.Fatal(err)
+	}
+	if c.last() != 3 {
+		t.Fatalf("expect watermark 3, got %v", c.offsets)
+	}
+
+	// partitions are committed separately
+	if err := o.ack(kMessage(1, 7), c.commit); err != nil {
+		t.Fatal(err)
+	}
+	if c.last() != 7 || len(c.offsets) != 2 {
+		t.Fatalf("expect watermark 7, got %v", c.offsets)
+	}
+	if n := len(o.slots); n != 0 {
+		t.Fatalf("expect all slots released, got %d", n)
+	}
+
+	// msgs not pending are ignored
+	if err := o.ack(kMessage(0, 2), c.commit); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.ack(kMessage(2, 1), c.commit); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.offsets) != 2 {
+		t.Fatalf("expect no more commit, got %v", c.offsets)
+	}
+}
+
+func TestKOffsetsNack(t *testing.T) {
+	o := newKOffsets(10, 50*time.Millisecond)
+	c := &committer{}
+	fetchAll(t, o, kMessage(0, 1), kMessage(0, 2))
+
+	o.nack(kMessage(0, 1))
+	if err := o.ack(kMessage(0, 2), c.commit); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.offsets) != 0 {
+		t.Fatalf("expect watermark stopped before nacked msg, got %v", c.offsets)
+	}
+
+	_, wait, ok := o.redelivery()
+	if ok || wait <= 0 {
+		t.Fatalf("expect nacked msg not due yet, got %v %v", wait, ok)
+	}
+	time.Sleep(wait)
+	message, _, ok := o.redelivery()
+	if !ok || message.Offset != 1 {
+		t.Fatalf("expect nacked msg delivered again, got %v %v", message.Offset, ok)
+	}
+	if _, wait, ok = o.redelivery(); ok || wait != 0 {
+		t.Fatal("expect no more msg to deliver again")
+	}
+
+	// the msg delivered again is consumed successfully
+	if err := o.ack(message, c.commit); err != nil {
+		t.Fatal(err)
+	}
+	if c.last() != 2 {
+		t.Fatalf("expect watermark 2, got %v", c.offsets)
+	}
+}
+
+func TestKOffsetsLimit(t *testing.T) {
+	o := newKOffsets(2, time.Second)
+	c := &committer{}
+	fetchAll(t, o, kMessage(0, 1), kMessage(0, 2))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := o.acquire(ctx); err == nil {
+		t.Fatal("expect fetching to wait when too many offsets are pending")
+	}
+
+	if err := o.ack(kMessage(0, 2), c.commit); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.ack(kMessage(0, 1), c.commit); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKOffsetsRebalance(t *testing.T) {
+	o := newKOffsets(10, time.Second)
+	c := &committer{}
+	fetchAll(t, o, kMessage(0, 1), kMessage(0, 2), kMessage(1, 5), kMessage(1, 6))
+	o.nack(kMessage(1, 5))
+
+	// offsets of partitions which may have been revoked aren't committed
+	o.rebalanced()
+	if err := o.ack(kMessage(0, 1), c.commit); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.offsets) != 0 {
+		t.Fatalf("expect nothing committed for stale partition, got %v", c.offsets)
+	}
+
+	// partition 0 is read again from the committed offset, its state is dropped
+	fetchAll(t, o, kMessage(0, 1))
+	if err := o.ack(kMessage(0, 2), c.commit); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.offsets) != 0 {
+		t.Fatalf("expect msg fetched before rewind ignored, got %v", c.offsets)
+	}
+	if err := o.ack(kMessage(0, 1), c.commit); err != nil {
+		t.Fatal(err)
+	}
+	if c.last() != 1 {
+		t.Fatalf("expect watermark 1, got %v", c.offsets)
+	}
+
+	// partition 1 isn't fetched from until the next rebalance, it's been revoked
+	o.rebalanced()
+	if _, ok := o.partitions[kPartition{topic: "test", partition: 1}]; ok {
+		t.Fatal("expect revoked partition dropped")
+	}
+	if len(o.redeliveries) != 0 {
+		t.Fatal("expect nacked msgs of revoked partition dropped")
+	}
+	if n := len(o.slots); n != 0 {
+		t.Fatalf("expect all slots released, got %d", n)
+	}
+}
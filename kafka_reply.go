@@ -0,0 +1,159 @@
+package windy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"github.com/visforest/windy/core"
+	"sync"
+	"time"
+)
+
+// replyTopic returns the reply topic name of topic
+func replyTopic(topic string) string {
+	return topic + ".reply"
+}
+
+// kReplyInbox reads replies from all the partitions of reply topic, and dispatches them to the requests waiting by correlation id.
+// Every producer reads all the replies, and drops the ones of requests sent by others.
+type kReplyInbox struct {
+	mu      sync.Mutex
+	started bool
+	waiters map[string]chan *core.Msg
+	readers []*kafka.Reader
+	stop    context.CancelFunc
+}
+
+// startReplyInbox starts to read replies from the latest offsets of reply topic, c.replies.mu must be held
+func (c *kClient) startReplyInbox() error {
+	topic := replyTopic(c.topic)
+	partitions, err := c.conn.ReadPartitions(topic)
+	if err != nil {
+		return err
+	}
+	ctx, stop := context.WithCancel(c.ctx)
+	readers := make([]*kafka.Reader, 0, len(partitions))
+	for _, p := range partitions {
+		// replies written before reading starts must not be missed, so the offset is fixed before request is sent
+		offset, err := c.lastOffset(ctx, topic, p.ID)
+		if err != nil {
+			stop()
+			for _, reader := range readers {
+				_ = reader.Close()
+			}
+			return err
+		}
+		reader := kafka.NewReader(kafka.ReaderConfig{
+			Brokers:   c.brokers,
+			Topic:     topic,
+			Partition: p.ID,
+			Dialer:    c.dialer,
+			MaxWait:   100 * time.Millisecond,
+		})
+		if err = reader.SetOffset(offset); err != nil {
+			stop()
+			_ = reader.Close()
+			for _, reader := range readers {
+				_ = reader.Close()
+			}
+			return err
+		}
+		readers = append(readers, reader)
+	}
+	for _, reader := range readers {
+		go c.readReplies(ctx, reader)
+	}
+	c.replies.readers = readers
+	c.replies.stop = stop
+	c.replies.started = true
+	return nil
+}
+
+// lastOffset returns the offset of the next msg written to partition of topic
+func (c *kClient) lastOffset(ctx context.Context, topic string, partition int) (int64, error) {
+	conn, err := c.dialer.DialLeader(ctx, "tcp", c.brokers[0], topic, partition)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	return conn.ReadLastOffset()
+}
+
+// readReplies reads replies in loop and dispatches them until ctx is done
+func (c *kClient) readReplies(ctx context.Context, reader *kafka.Reader) {
+	for {
+		message, err := reader.ReadMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			fmt.Println("reply err:", err)
+			continue
+		}
+		m, err := decodeKMsg(message)
+		if err != nil {
+			fmt.Println("reply err:", err)
+			continue
+		}
+		c.replies.mu.Lock()
+		if replies, ok := c.replies.waiters[m.CorrelationId]; ok {
+			select {
+			case replies <- m:
+			default:
+			}
+		}
+		c.replies.mu.Unlock()
+	}
+}
+
+// Subscribe receives the reply of correlation id from topic '<topic>.reply'
+func (c *kClient) Subscribe(correlationId string) (string, <-chan *core.Msg, func(), error) {
+	if c.replies == nil {
+		return "", nil, nil, errors.New("request is only supported by producer")
+	}
+	c.replies.mu.Lock()
+	defer c.replies.mu.Unlock()
+	if !c.replies.started {
+		if err := c.startReplyInbox(); err != nil {
+			return "", nil, nil, err
+		}
+	}
+	replies := make(chan *core.Msg, 1)
+	c.replies.waiters[correlationId] = replies
+	return replyTopic(c.topic), replies, func() {
+		c.replies.mu.Lock()
+		defer c.replies.mu.Unlock()
+		delete(c.replies.waiters, correlationId)
+	}, nil
+}
+
+// Reply writes reply to topic replyTo
+func (c *kClient) Reply(replyTo string, reply *core.Msg) error {
+	message, err := c.encode(reply)
+	if err != nil {
+		return err
+	}
+	message.Topic = replyTo
+	message.Key = []byte(reply.CorrelationId)
+	return c.writer.WriteMessages(c.ctx, message)
+}
+
+// closeReplyInbox stops reading replies
+func (c *kClient) closeReplyInbox() error {
+	if c.replies == nil {
+		return nil
+	}
+	c.replies.mu.Lock()
+	defer c.replies.mu.Unlock()
+	if !c.replies.started {
+		return nil
+	}
+	c.replies.stop()
+	var errs []error
+	for _, reader := range c.replies.readers {
+		errs = append(errs, reader.Close())
+	}
+	c.replies.started = false
+	return errors.Join(errs...)
+}
@@ -0,0 +1,101 @@
+package windy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+	"os"
+	"time"
+)
+
+// kafkaSecurity holds the TLS and SASL settings shared by writer, readers and admin connections
+type kafkaSecurity struct {
+	tls  *tls.Config
+	sasl sasl.Mechanism
+}
+
+// newKafkaSecurity returns the security settings of cfg, both of tls and sasl are nil if they aren't configured
+func newKafkaSecurity(cfg *KafkaConf) (*kafkaSecurity, error) {
+	tlsConfig, err := newKafkaTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	mechanism, err := newKafkaSASLMechanism(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaSecurity{tls: tlsConfig, sasl: mechanism}, nil
+}
+
+// newKafkaTLSConfig returns the tls config of cfg, or nil if TLS isn't enabled
+func newKafkaTLSConfig(cfg *KafkaConf) (*tls.Config, error) {
+	if !cfg.TLS && cfg.CaFile == "" && cfg.CertFile == "" && cfg.KeyFile == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CaFile != "" {
+		caCert, err := os.ReadFile(cfg.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		caCertPool := x509.NewCertPool()
+		if ok := caCertPool.AppendCertsFromPEM(caCert); !ok {
+			return nil, errors.New("certificate file is invalid")
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, errors.New("cert file and key file must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// newKafkaSASLMechanism returns the sasl mechanism of cfg, or nil if SASL isn't enabled
+func newKafkaSASLMechanism(cfg *KafkaConf) (sasl.Mechanism, error) {
+	if cfg.Username == "" {
+		return nil, nil
+	}
+	switch cfg.SaslMechanism {
+	case "", SaslPlain:
+		return plain.Mechanism{Username: cfg.Username, Password: cfg.Password}, nil
+	case SaslScramSha256:
+		return scram.Mechanism(scram.SHA256, cfg.Username, cfg.Password)
+	case SaslScramSha512:
+		return scram.Mechanism(scram.SHA512, cfg.Username, cfg.Password)
+	default:
+		return nil, fmt.Errorf("unsupported sasl mechanism '%s'", cfg.SaslMechanism)
+	}
+}
+
+// dialer returns a dialer for readers and admin connections
+func (s *kafkaSecurity) dialer() *kafka.Dialer {
+	return &kafka.Dialer{
+		Timeout:       10 * time.Second,
+		DualStack:     true,
+		TLS:           s.tls,
+		SASLMechanism: s.sasl,
+	}
+}
+
+// transport returns a transport for writers
+func (s *kafkaSecurity) transport() *kafka.Transport {
+	return &kafka.Transport{
+		TLS:  s.tls,
+		SASL: s.sasl,
+	}
+}
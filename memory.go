@@ -0,0 +1,410 @@
+package windy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Visforest/goset/v2"
+	"github.com/visforest/windy/core"
+)
+
+// the interval to check delay msgs and msgs whose visibility timeout expired when there's no msg to fetch
+const memoryPollInterval = 100 * time.Millisecond
+
+// MBroker is a broker in memory, which is shared by MProducer and MConsumer in the same process.
+// It's useful for tests and single process applications.
+type MBroker struct {
+	mu     sync.Mutex
+	topics map[string]*mTopic
+}
+
+// NewMBroker returns an empty broker in memory
+func NewMBroker() *MBroker {
+	return &MBroker{topics: make(map[string]*mTopic)}
+}
+
+// topic returns topic of name, it's created if missing
+func (b *MBroker) topic(name string) *mTopic {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, ok := b.topics[name]
+	if !ok {
+		t = &mTopic{groups: make(map[string]*mGroup), replies: make(map[string]chan<- *core.Msg)}
+		b.topics[name] = t
+	}
+	return t
+}
+
+// mTopic delivers each msg to every consumer group of it.
+// Msgs sent before any group joins are kept in backlog, and are taken over by the first group.
+type mTopic struct {
+	mu      sync.Mutex
+	groups  map[string]*mGroup
+	backlog *mGroup
+	replies map[string]chan<- *core.Msg // reply channels of requests by correlation id
+}
+
+// group returns consumer group of name, it's created if missing
+func (t *mTopic) group(name string) *mGroup {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	g, ok := t.groups[name]
+	if !ok {
+		if len(t.groups) == 0 && t.backlog != nil {
+			g = t.backlog
+			t.backlog = nil
+		} else {
+			g = newMGroup()
+		}
+		t.groups[name] = g
+	}
+	return g
+}
+
+func (t *mTopic) push(val string, delayAt *time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.groups) == 0 {
+		if t.backlog == nil {
+			t.backlog = newMGroup()
+		}
+		t.backlog.push(val, delayAt)
+		return
+	}
+	for _, g := range t.groups {
+		g.push(val, delayAt)
+	}
+}
+
+// subscribe registers the reply channel of correlation id
+func (t *mTopic) subscribe(correlationId string, replies chan<- *core.Msg) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.replies[correlationId] = replies
+}
+
+// unsubscribe removes the reply channel of correlation id
+func (t *mTopic) unsubscribe(correlationId string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.replies, correlationId)
+}
+
+// reply sends reply to the channel of correlation id, it's dropped if nobody is waiting for it
+func (t *mTopic) reply(correlationId string, reply *core.Msg) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if replies, ok := t.replies[correlationId]; ok {
+		select {
+		case replies <- reply:
+		default:
+		}
+	}
+}
+
+// mEntry is a msg kept in a consumer group
+type mEntry struct {
+	val string
+	at  time.Time // the time at which a delay msg gets ready, or the visibility deadline of an in-flight msg
+}
+
+// mGroup is a consumer group, msgs in it are consumed by only one of the consumers
+type mGroup struct {
+	mu       sync.Mutex
+	ready    []*mEntry
+	delayed  []*mEntry
+	inflight map[*mEntry]struct{}
+	notify   chan struct{}
+}
+
+func newMGroup() *mGroup {
+	return &mGroup{
+		inflight: make(map[*mEntry]struct{}),
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+func (g *mGroup) push(val string, delayAt *time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if delayAt != nil && delayAt.After(time.Now()) {
+		g.delayed = append(g.delayed, &mEntry{val: val, at: *delayAt})
+		return
+	}
+	g.ready = append(g.ready, &mEntry{val: val})
+	g.wake()
+}
+
+// wake notifies a fetcher waiting for msgs, g.mu must be held
+func (g *mGroup) wake() {
+	select {
+	case g.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the earliest ready msg and keeps it in flight until visibility timeout, or nil if there's no ready msg
+func (g *mGroup) pop(visibilityTimeout time.Duration) *mEntry {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.ready) == 0 {
+		return nil
+	}
+	e := g.ready[0]
+	g.ready = g.ready[1:]
+	e.at = time.Now().Add(visibilityTimeout)
+	g.inflight[e] = struct{}{}
+	if len(g.ready) > 0 {
+		// let other fetchers go on
+		g.wake()
+	}
+	return e
+}
+
+// ack removes in-flight msg
+func (g *mGroup) ack(e *mEntry) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.inflight, e)
+}
+
+// promote makes ready the delay msgs whose time arrives and the in-flight msgs whose visibility timeout expires
+func (g *mGroup) promote() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	delayed := g.delayed[:0]
+	for _, e := range g.delayed {
+		if e.at.After(now) {
+			delayed = append(delayed, e)
+		} else {
+			g.ready = append(g.ready, e)
+		}
+	}
+	g.delayed = delayed
+	for e := range g.inflight {
+		if !e.at.After(now) {
+			delete(g.inflight, e)
+			g.ready = append(g.ready, e)
+		}
+	}
+	if len(g.ready) > 0 {
+		g.wake()
+	}
+}
+
+// mClient is a client backed by MBroker, which implements core.Producer and core.Consumer
+type mClient struct {
+	topic             *mTopic
+	group             *mGroup // only for consumer
+	visibilityTimeout time.Duration
+	encoder           core.MsgEncoder // the encoder with which msgs are encoded
+}
+
+// Push sends msg to all the groups of topic, or only the group of consumer if it's a consumer client
+func (c *mClient) Push(m *core.Msg) error {
+	val, err := c.encoder.Encode(m)
+	if err != nil {
+		return err
+	}
+	if c.group != nil {
+		// msgs sent by consumer are retried ones, which belong to its own group
+		c.group.push(string(val), m.DelayAt)
+	} else {
+		c.topic.push(string(val), m.DelayAt)
+	}
+	return nil
+}
+
+// PushBatch sends msgs one by one
+func (c *mClient) PushBatch(ms []*core.Msg) []error {
+	errs := make([]error, len(ms))
+	for i, m := range ms {
+		errs[i] = c.Push(m)
+	}
+	return batchErrs(errs)
+}
+
+// Subscribe receives the reply of correlation id, whose reply destination is correlation id itself
+func (c *mClient) Subscribe(correlationId string) (string, <-chan *core.Msg, func(), error) {
+	replies := make(chan *core.Msg, 1)
+	c.topic.subscribe(correlationId, replies)
+	return correlationId, replies, func() {
+		c.topic.unsubscribe(correlationId)
+	}, nil
+}
+
+// Reply sends reply to the requester waiting for it
+func (c *mClient) Reply(replyTo string, reply *core.Msg) error {
+	// encode and decode reply as other backends do
+	val, err := c.encoder.Encode(reply)
+	if err != nil {
+		return err
+	}
+	m, err := core.DecodeMsgFromBytes(val)
+	if err != nil {
+		return err
+	}
+	c.topic.reply(replyTo, m)
+	return nil
+}
+
+func (c *mClient) Fetch(ctx context.Context) (*core.Msg, error) {
+	for {
+		if e := c.group.pop(c.visibilityTimeout); e != nil {
+			m, err := core.DecodeMsgFromStr(e.val)
+			if err != nil {
+				c.group.ack(e)
+				return nil, err
+			}
+			m.SetAckToken(e)
+			return m, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-c.group.notify:
+		case <-time.After(memoryPollInterval):
+			c.group.promote()
+		}
+	}
+}
+
+// FetchDelayMsgs makes ready delay msgs available to Fetch, so it always returns no msg
+func (c *mClient) FetchDelayMsgs() ([]*core.Msg, error) {
+	c.group.promote()
+	return nil, nil
+}
+
+// Ack removes msg from consumer group
+func (c *mClient) Ack(m *core.Msg) error {
+	if e, ok := m.AckToken().(*mEntry); ok {
+		c.group.ack(e)
+	}
+	return nil
+}
+
+// Nack keeps msg in flight, it'll be redelivered after visibility timeout
+func (c *mClient) Nack(m *core.Msg, err error) error {
+	return nil
+}
+
+type MProducer struct {
+	producerCore *core.ProducerCore
+	client       *mClient
+}
+
+// NewMProducer returns a producer which sends msgs to broker
+func NewMProducer(broker *MBroker, cfg *MConf, opts ...core.ProducerOption) *MProducer {
+	producerCore := &core.ProducerCore{
+		Ctx:       context.Background(),
+		Topic:     cfg.Topic,
+		IdCreator: core.DefaultIdCreator,
+	}
+	for _, opt := range opts {
+		opt(producerCore)
+	}
+	return &MProducer{
+		producerCore: producerCore,
+		client:       &mClient{topic: broker.topic(cfg.Topic), encoder: producerCore.MsgEncoder()},
+	}
+}
+
+// Send sends data to broker
+func (p *MProducer) Send(data any, opts ...core.MsgOption) (string, error) {
+	return p.producerCore.Send(p.client, core.NewMsg(data, opts...))
+}
+
+// SendMsg sends msg as it is, msg id is kept if it's set
+func (p *MProducer) SendMsg(m *core.Msg) (string, error) {
+	return p.producerCore.Send(p.client, m)
+}
+
+// Request sends data as a request, and blocks until its reply is received or ctx is done
+func (p *MProducer) Request(ctx context.Context, data any, opts ...core.MsgOption) (*core.Msg, error) {
+	return p.producerCore.Request(ctx, p.client, p.client, core.NewMsg(data, opts...))
+}
+
+// SendBatch sends data items to message queue, ids are returned in order, and the id of item failed to be sent is empty.
+// If some items are failed to be sent, a *core.BatchError is returned.
+func (p *MProducer) SendBatch(items []any, opts ...core.MsgOption) ([]string, error) {
+	return p.producerCore.SendBatch(p.client, core.NewMsgs(items, opts...))
+}
+
+// SendAsync buffers data and returns msg id, msg is sent in background and the result is reported by listener.
+// It blocks if the buffer is full, and returns core.ErrProducerClosed after producer is closed.
+func (p *MProducer) SendAsync(data any, opts ...core.MsgOption) (string, error) {
+	return p.producerCore.SendAsync(p.client, core.NewMsg(data, opts...))
+}
+
+// Flush blocks until the msgs buffered by SendAsync before are sent or ctx is done
+func (p *MProducer) Flush(ctx context.Context) error {
+	return p.producerCore.Flush(ctx)
+}
+
+// Close sends all the msgs buffered by SendAsync, and msgs sent asynchronously after it are rejected
+func (p *MProducer) Close(ctx context.Context) error {
+	return p.producerCore.Close(ctx, nil)
+}
+
+type MConsumer struct {
+	consumerCore *core.ConsumerCore
+	client       *mClient
+}
+
+// NewMConsumer returns a consumer which consumes msgs from broker
+func NewMConsumer(broker *MBroker, cfg *MConf, handler core.ConsumeFunc, opts ...core.ConsumerOption) *MConsumer {
+	var batchProcess *BatchProcessConf
+	if cfg.BatchProcess == nil {
+		batchProcess = &BatchProcessConf{}
+	} else {
+		batchProcess = cfg.BatchProcess
+	}
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = 4
+	}
+	visibilityTimeout := cfg.VisibilityTimeout
+	if visibilityTimeout <= 0 {
+		visibilityTimeout = 60
+	}
+	consumerCore := &core.ConsumerCore{
+		Ctx:                 context.Background(),
+		Topic:               cfg.Topic,
+		WorkersNum:          workers,
+		Processors:          goset.NewSortedSet[core.ProcessorType](),
+		ConsumeFunc:         handler,
+		BatchProcessCnt:     batchProcess.Batch,
+		BatchProcessTimeout: time.Duration(batchProcess.Timeout) * time.Second,
+	}
+	for _, opt := range opts {
+		opt(consumerCore)
+	}
+	topic := broker.topic(cfg.Topic)
+	return &MConsumer{
+		consumerCore: consumerCore,
+		client: &mClient{
+			topic:             topic,
+			group:             topic.group(cfg.Group),
+			visibilityTimeout: time.Duration(visibilityTimeout) * time.Second,
+			encoder:           consumerCore.MsgEncoder(),
+		},
+	}
+}
+
+// LoopConsume blocks and consumes msgs in loop with multi goroutine, until it gets a quit signal
+func (c *MConsumer) LoopConsume() {
+	c.consumerCore.LoopConsume(c.client)
+}
+
+// Start starts to consume msgs in background, msgs are fetched until ctx is done or Shutdown is called
+func (c *MConsumer) Start(ctx context.Context) error {
+	return c.consumerCore.Start(ctx, c.client)
+}
+
+// Shutdown stops fetching msgs, and waits until the fetched ones are consumed and acknowledged or ctx is done.
+// The msgs unacknowledged are kept in broker.
+func (c *MConsumer) Shutdown(ctx context.Context) error {
+	return c.consumerCore.Shutdown(ctx)
+}
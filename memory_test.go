@@ -0,0 +1,305 @@
+package windy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/visforest/windy/core"
+)
+
+// recorder records data of msgs consumed
+type recorder struct {
+	mu   sync.Mutex
+	data []string
+}
+
+func (r *recorder) handle(ctx context.Context, topic string, msg *core.Msg) error {
+	data, err := core.DecodeData[string](msg)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.data = append(r.data, data)
+	return nil
+}
+
+func (r *recorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.data)
+}
+
+// waitFor waits until cond is true, it fails if cond is still false after timeout
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for !cond() {
+		select {
+		case <-deadline.C:
+			t.Fatal("timeout")
+		case <-ticker.C:
+		}
+	}
+}
+
+// idle returns whether group of topic has no msg ready, delayed or in flight, no more msg is delivered to it then
+func idle(broker *MBroker, topic, group string) func() bool {
+	g := broker.topic(topic).group(group)
+	return func() bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return len(g.ready) == 0 && len(g.delayed) == 0 && len(g.inflight) == 0
+	}
+}
+
+func startMConsumer(t *testing.T, broker *MBroker, cfg *MConf, handler core.ConsumeFunc, opts ...core.ConsumerOption) *MConsumer {
+	t.Helper()
+	consumer := NewMConsumer(broker, cfg, handler, opts...)
+	if err := consumer.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = consumer.Shutdown(context.Background())
+	})
+	return consumer
+}
+
+func TestMemoryNormal(t *testing.T) {
+	broker := NewMBroker()
+	cfg := &MConf{Topic: "normal", Group: "g"}
+	producer := NewMProducer(broker, cfg)
+	for _, data := range []string{"a", "b", "c"} {
+		if _, err := producer.Send(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := &recorder{}
+	startMConsumer(t, broker, cfg, r.handle)
+	waitFor(t, time.Second, func() bool { return r.count() == 3 })
+}
+
+func TestMemoryDelayed(t *testing.T) {
+	broker := NewMBroker()
+	cfg := &MConf{Topic: "delayed", Group: "g"}
+	consumed := make(chan time.Time, 1)
+	startMConsumer(t, broker, cfg, func(ctx context.Context, topic string, msg *core.Msg) error {
+		consumed <- time.Now()
+		return nil
+	})
+	delayAt := time.Now().Add(300 * time.Millisecond)
+	if _, err := NewMProducer(broker, cfg).Send("a", core.WithDelayTime(&delayAt)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case at := <-consumed:
+		if at.Before(delayAt) {
+			t.Fatal("delay msg is consumed early")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestMemoryExpired(t *testing.T) {
+	broker := NewMBroker()
+	cfg := &MConf{Topic: "expired", Group: "g"}
+	producer := NewMProducer(broker, cfg)
+	// msg expired already before it's consumed
+	m := core.NewMsg("expired")
+	expireAt := time.Now().Add(-time.Second)
+	m.ExpireAt = &expireAt
+	expiredId, err := producer.SendMsg(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := producer.Send("alive"); err != nil {
+		t.Fatal(err)
+	}
+	r := &recorder{}
+	expired := make(chan string, 2)
+	startMConsumer(t, broker, cfg, r.handle, core.WithExpiredSink(func(ctx context.Context, topic string, msg *core.Msg) error {
+		expired <- msg.Id
+		return nil
+	}))
+	select {
+	case id := <-expired:
+		if id != expiredId {
+			t.Fatal(id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	waitFor(t, time.Second, func() bool { return r.count() == 1 })
+	waitFor(t, time.Second, idle(broker, "expired", "g"))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(expired) != 0 || r.data[0] != "alive" {
+		t.Fatal(len(expired), r.data)
+	}
+}
+
+func TestMemoryAckAndVisibility(t *testing.T) {
+	broker := NewMBroker()
+	cfg := &MConf{Topic: "visibility", Group: "g", Workers: 1, VisibilityTimeout: 1}
+	producer := NewMProducer(broker, cfg)
+	for _, data := range []string{"ok", "fail"} {
+		if _, err := producer.Send(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	startMConsumer(t, broker, cfg, func(ctx context.Context, topic string, msg *core.Msg) error {
+		data, _ := core.DecodeData[string](msg)
+		mu.Lock()
+		defer mu.Unlock()
+		calls[data]++
+		if data == "fail" && calls[data] == 1 {
+			return errors.New("fail")
+		}
+		return nil
+	})
+	// the failed msg is redelivered after visibility timeout, and the acknowledged one is not
+	waitFor(t, 3*time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls["fail"] == 2
+	})
+	waitFor(t, time.Second, idle(broker, "visibility", "g"))
+	mu.Lock()
+	defer mu.Unlock()
+	if calls["ok"] != 1 || calls["fail"] != 2 {
+		t.Fatal(calls)
+	}
+}
+
+func TestMemoryGroups(t *testing.T) {
+	broker := NewMBroker()
+	cfg1 := &MConf{Topic: "groups", Group: "g1"}
+	cfg2 := &MConf{Topic: "groups", Group: "g2"}
+	// consumers of the same group share msgs, and each group gets all the msgs
+	r1, r2 := &recorder{}, &recorder{}
+	startMConsumer(t, broker, cfg1, r1.handle)
+	startMConsumer(t, broker, cfg1, r1.handle)
+	startMConsumer(t, broker, cfg2, r2.handle)
+	producer := NewMProducer(broker, cfg1)
+	for i := 0; i < 10; i++ {
+		if _, err := producer.Send("a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, time.Second, func() bool { return r1.count() == 10 && r2.count() == 10 })
+	waitFor(t, time.Second, idle(broker, "groups", "g1"))
+	waitFor(t, time.Second, idle(broker, "groups", "g2"))
+	if r1.count() != 10 || r2.count() != 10 {
+		t.Fatal(r1.count(), r2.count())
+	}
+}
+
+func TestMemoryRetryInGroup(t *testing.T) {
+	broker := NewMBroker()
+	cfg1 := &MConf{Topic: "retry", Group: "g1"}
+	cfg2 := &MConf{Topic: "retry", Group: "g2"}
+	var mu sync.Mutex
+	attempts := 0
+	startMConsumer(t, broker, cfg1, func(ctx context.Context, topic string, msg *core.Msg) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts == 1 {
+			return errors.New("fail")
+		}
+		return nil
+	}, core.WithRetryPolicy(&core.RetryPolicy{MaxAttempts: 3, InitialBackoff: 10 * time.Millisecond}))
+	r2 := &recorder{}
+	startMConsumer(t, broker, cfg2, r2.handle)
+	if _, err := NewMProducer(broker, cfg1).Send("a"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 2*time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return attempts == 2
+	})
+	waitFor(t, time.Second, idle(broker, "retry", "g1"))
+	waitFor(t, time.Second, idle(broker, "retry", "g2"))
+	// the msg failed in g1 is retried in g1 only
+	if r2.count() != 1 {
+		t.Fatal(r2.count())
+	}
+}
+
+func TestMemoryDedupRedelivery(t *testing.T) {
+	broker := NewMBroker()
+	cfg := &MConf{Topic: "dedup", Group: "g", Workers: 1, VisibilityTimeout: 1, BatchProcess: &BatchProcessConf{Batch: 1, Timeout: 1}}
+	producer := NewMProducer(broker, cfg)
+	// the second one is a duplicate
+	for _, data := range []string{"a", "a"} {
+		if _, err := producer.Send(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var mu sync.Mutex
+	calls := 0
+	uniq := func(m *core.Msg) string {
+		data, _ := core.DecodeData[string](m)
+		return data
+	}
+	startMConsumer(t, broker, cfg, func(ctx context.Context, topic string, msg *core.Msg) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 1 {
+			return errors.New("fail")
+		}
+		return nil
+	}, core.WithUniqFunc(uniq), core.WithDedupStore(core.NewMemoryDedupStore(100), time.Minute))
+	// the failed msg is redelivered rather than dropped as a duplicate, and the duplicate is dropped
+	waitFor(t, 3*time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls == 2
+	})
+	waitFor(t, time.Second, idle(broker, "dedup", "g"))
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 2 {
+		t.Fatal(calls)
+	}
+}
+
+func TestMemoryUniqIds(t *testing.T) {
+	broker := NewMBroker()
+	cfg := &MConf{Topic: "ids", Group: "g"}
+	producers := []*MProducer{NewMProducer(broker, cfg), NewMProducer(broker, cfg)}
+	var mu sync.Mutex
+	ids := make(map[string]struct{})
+	var wg sync.WaitGroup
+	for _, producer := range producers {
+		wg.Add(1)
+		go func(producer *MProducer) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				id, err := producer.Send("a")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				ids[id] = struct{}{}
+				mu.Unlock()
+			}
+		}(producer)
+	}
+	wg.Wait()
+	if len(ids) != 1000 {
+		t.Fatal("duplicate ids:", 1000-len(ids))
+	}
+}
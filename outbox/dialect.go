@@ -0,0 +1,82 @@
+package outbox
+
+import (
+	"fmt"
+)
+
+// Dialect is the SQL dialect of database in which outbox table is kept
+type Dialect struct {
+	Name string
+
+	// SkipLocked tells whether database supports 'SELECT ... FOR UPDATE SKIP LOCKED', with which multi relays run together
+	SkipLocked bool
+
+	// placeholder returns the placeholder of the nth parameter, n starts from 1
+	placeholder func(n int) string
+
+	// the DDL of outbox table and its index on (topic, id) by which rows are polled, %[1]s is table name
+	createTable []string
+}
+
+var (
+	// Postgres is the dialect of PostgreSQL 9.5+
+	Postgres = Dialect{
+		Name:       "postgres",
+		SkipLocked: true,
+		placeholder: func(n int) string {
+			return fmt.Sprintf("$%d", n)
+		},
+		createTable: []string{`CREATE TABLE IF NOT EXISTS %[1]s (
+	id BIGSERIAL PRIMARY KEY,
+	topic VARCHAR(255) NOT NULL,
+	msg_id VARCHAR(64) NOT NULL,
+	payload BYTEA NOT NULL,
+	created_at TIMESTAMP NOT NULL
+)`, `CREATE INDEX IF NOT EXISTS %[1]s_topic_id ON %[1]s (topic, id)`},
+	}
+
+	// MySQL is the dialect of MySQL 8.0+
+	MySQL = Dialect{
+		Name:       "mysql",
+		SkipLocked: true,
+		placeholder: func(n int) string {
+			return "?"
+		},
+		createTable: []string{`CREATE TABLE IF NOT EXISTS %[1]s (
+	id BIGINT AUTO_INCREMENT PRIMARY KEY,
+	topic VARCHAR(255) NOT NULL,
+	msg_id VARCHAR(64) NOT NULL,
+	payload LONGBLOB NOT NULL,
+	created_at DATETIME(6) NOT NULL,
+	INDEX idx_topic_id (topic, id)
+)`},
+	}
+
+	// SQLite is the dialect of SQLite, only one relay should run since it doesn't support SKIP LOCKED
+	SQLite = Dialect{
+		Name:       "sqlite",
+		SkipLocked: false,
+		placeholder: func(n int) string {
+			return "?"
+		},
+		createTable: []string{`CREATE TABLE IF NOT EXISTS %[1]s (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	topic VARCHAR(255) NOT NULL,
+	msg_id VARCHAR(64) NOT NULL,
+	payload BLOB NOT NULL,
+	created_at TIMESTAMP NOT NULL
+)`, `CREATE INDEX IF NOT EXISTS %[1]s_topic_id ON %[1]s (topic, id)`},
+	}
+)
+
+// placeholders returns the placeholders of parameters from the nth to the (n+count-1)th, separated by comma
+func (d Dialect) placeholders(n, count int) string {
+	var s string
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			s += ","
+		}
+		s += d.placeholder(n + i)
+	}
+	return s
+}
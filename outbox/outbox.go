@@ -0,0 +1,79 @@
+// Package outbox implements the transactional outbox pattern: msgs are written into an outbox table within the transaction
+// of your business data, and then relayed to message queue by any windy producer, so that msgs are never lost
+// even if the process dies after the transaction is committed.
+// Msgs are relayed at least once and keep their ids, which can be used by consumers to deduplicate.
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/visforest/windy/core"
+	"time"
+)
+
+// Outbox writes msgs of a topic into outbox table
+type Outbox struct {
+	producerCore *core.ProducerCore
+	encoder      core.MsgEncoder
+	dialect      Dialect
+	table        string
+}
+
+// New returns an outbox which writes msgs of topic into table, id creator, codec, compression and listener of producer options are used.
+// Listener is called by relay when msgs are really sent, rather than when they're written.
+func New(dialect Dialect, table, topic string, opts ...core.ProducerOption) *Outbox {
+	producerCore := &core.ProducerCore{
+		Ctx:       context.Background(),
+		Topic:     topic,
+		IdCreator: core.DefaultIdCreator,
+	}
+	for _, opt := range opts {
+		opt(producerCore)
+	}
+	return &Outbox{
+		producerCore: producerCore,
+		encoder:      producerCore.MsgEncoder(),
+		dialect:      dialect,
+		table:        table,
+	}
+}
+
+// CreateTable creates outbox table and its index if they're missing
+func (o *Outbox) CreateTable(ctx context.Context, db *sql.DB) error {
+	for _, stmt := range o.dialect.createTable {
+		if _, err := db.ExecContext(ctx, fmt.Sprintf(stmt, o.table)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write writes data into outbox table within tx and returns msg id, msg is relayed after tx is committed
+func (o *Outbox) Write(ctx context.Context, tx *sql.Tx, data any, opts ...core.MsgOption) (string, error) {
+	m := core.NewMsg(data, opts...)
+	m.Id = o.producerCore.IdCreator.Create()
+	w := &txWriter{ctx: ctx, tx: tx, outbox: o}
+	if err := w.Push(m); err != nil {
+		return "", err
+	}
+	return m.Id, nil
+}
+
+// txWriter writes msgs into outbox table within a transaction
+type txWriter struct {
+	ctx    context.Context
+	tx     *sql.Tx
+	outbox *Outbox
+}
+
+func (w *txWriter) Push(m *core.Msg) error {
+	payload, err := w.outbox.encoder.Encode(m)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf("INSERT INTO %s (topic, msg_id, payload, created_at) VALUES (%s)",
+		w.outbox.table, w.outbox.dialect.placeholders(1, 4))
+	_, err = w.tx.ExecContext(w.ctx, query, w.outbox.producerCore.Topic, m.Id, payload, time.Now().UTC())
+	return err
+}
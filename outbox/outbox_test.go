@@ -0,0 +1,154 @@
+package outbox_test
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/visforest/windy"
+	"github.com/visforest/windy/core"
+	"github.com/visforest/windy/outbox"
+)
+
+func openSQLite(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", "file:"+t.TempDir()+"/outbox.db?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sqlite allows a single writer
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// sentListener records the ids of msgs sent successfully
+type sentListener struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+func (l *sentListener) PrepareSend(ctx context.Context, topic string, msg *core.Msg, err error) {}
+
+func (l *sentListener) OnSendSucceed(ctx context.Context, topic string, msg *core.Msg) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ids = append(l.ids, msg.Id)
+}
+
+func (l *sentListener) OnSendFail(ctx context.Context, topic string, msg *core.Msg, err error) {}
+
+func (l *sentListener) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.ids)
+}
+
+func TestOutboxRelay(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t)
+	listener := &sentListener{}
+	box := outbox.New(outbox.SQLite, "windy_outbox", "outbox_topic", core.WithProducerListener(listener))
+	if err := box.CreateTable(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+
+	// rows of committed transactions are relayed, rows of rolled back ones are not
+	committed := map[string]string{}
+	for _, data := range []string{"a", "b", "c", "rollback"} {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := box.Write(ctx, tx, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data == "rollback" {
+			if err := tx.Rollback(); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		committed[id] = data
+	}
+	// msgs written aren't sent until they're relayed
+	if n := listener.count(); n != 0 {
+		t.Fatalf("expect no msg sent before relay, got %d", n)
+	}
+
+	broker := windy.NewMBroker()
+	cfg := &windy.MConf{
+		Topic:        "outbox_topic",
+		BatchProcess: &windy.BatchProcessConf{Batch: 1, Timeout: 1},
+	}
+	var mu sync.Mutex
+	got := map[string]string{}
+	consumer := windy.NewMConsumer(broker, cfg, func(ctx context.Context, topic string, msg *core.Msg) error {
+		data, err := core.DecodeData[string](msg)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		got[msg.Id] = data
+		mu.Unlock()
+		return nil
+	})
+	if err := consumer.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := consumer.Shutdown(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	relay := outbox.NewRelay(db, box, windy.NewMProducer(broker, cfg), outbox.WithBatchSize(2))
+	for {
+		n, err := relay.RelayOnce(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			break
+		}
+	}
+
+	if n := listener.count(); n != len(committed) {
+		t.Fatalf("expect %d msgs sent, got %d", len(committed), n)
+	}
+
+	var rows int
+	if err := db.QueryRow("SELECT COUNT(*) FROM windy_outbox").Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 0 {
+		t.Fatalf("expect outbox emptied, got %d rows", rows)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(got)
+		mu.Unlock()
+		if n >= len(committed) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != len(committed) {
+		t.Fatalf("expect %d msgs, got %v", len(committed), got)
+	}
+	for id, data := range committed {
+		if got[id] != data {
+			t.Fatalf("msg %s: expect %q, got %q", id, data, got[id])
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/visforest/windy/core"
+	"time"
+)
+
+// MsgSender is implemented by all the windy producers
+type MsgSender interface {
+	// SendMsg sends msg as it is, msg id is kept
+	SendMsg(m *core.Msg) (string, error)
+}
+
+const (
+	// the default max count of rows relayed in a transaction
+	defaultRelayBatchSize = 100
+	// the default interval to poll outbox table when there's no row
+	defaultPollInterval = time.Second
+)
+
+type RelayOption func(r *Relay)
+
+// WithBatchSize sets the max count of rows relayed in a transaction, default 100
+func WithBatchSize(size int) RelayOption {
+	return func(r *Relay) {
+		r.batchSize = size
+	}
+}
+
+// WithPollInterval sets the interval to poll outbox table when there's no row, default 1s
+func WithPollInterval(interval time.Duration) RelayOption {
+	return func(r *Relay) {
+		r.pollInterval = interval
+	}
+}
+
+// msgPusher sends msgs as they are by sender
+type msgPusher struct {
+	sender MsgSender
+}
+
+func (p msgPusher) Push(m *core.Msg) error {
+	_, err := p.sender.SendMsg(m)
+	return err
+}
+
+// Relay polls rows of outbox and sends them by producer, rows are deleted after they're sent.
+// Rows are locked by 'SELECT ... FOR UPDATE SKIP LOCKED' if dialect supports, so that multi relays can run together.
+type Relay struct {
+	db           *sql.DB
+	outbox       *Outbox
+	producer     MsgSender
+	batchSize    int
+	pollInterval time.Duration
+}
+
+// NewRelay returns a relay which sends the rows written by outbox with producer, producer should be of the same topic as outbox
+func NewRelay(db *sql.DB, outbox *Outbox, producer MsgSender, opts ...RelayOption) *Relay {
+	r := &Relay{
+		db:       db,
+		outbox:   outbox,
+		producer: producer,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.batchSize <= 0 {
+		r.batchSize = defaultRelayBatchSize
+	}
+	if r.pollInterval <= 0 {
+		r.pollInterval = defaultPollInterval
+	}
+	return r
+}
+
+// Run relays rows in loop until ctx is done
+func (r *Relay) Run(ctx context.Context) error {
+	for {
+		n, err := r.RelayOnce(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			fmt.Println("outbox relay err:", err)
+		}
+		if n < r.batchSize {
+			// no more rows for now
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(r.pollInterval):
+			}
+		}
+	}
+}
+
+// RelayOnce relays a batch of rows in order within a transaction and returns the count of rows relayed.
+// It stops at the first row failed to be sent, which will be relayed next time.
+func (r *Relay) RelayOnce(ctx context.Context) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	d := r.outbox.dialect
+	query := fmt.Sprintf("SELECT id, payload FROM %s WHERE topic = %s ORDER BY id LIMIT %d",
+		r.outbox.table, d.placeholder(1), r.batchSize)
+	if d.SkipLocked {
+		query += " FOR UPDATE SKIP LOCKED"
+	}
+	rows, err := tx.QueryContext(ctx, query, r.outbox.producerCore.Topic)
+	if err != nil {
+		return 0, err
+	}
+	type row struct {
+		id      int64
+		payload []byte
+	}
+	var batch []row
+	for rows.Next() {
+		var rw row
+		if err = rows.Scan(&rw.id, &rw.payload); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, rw)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var done []any // ids of rows sent or discarded
+	var sendErr error
+	for _, rw := range batch {
+		m, err := core.DecodeMsgFromBytes(rw.payload)
+		if err != nil {
+			// bad row will never be sent successfully, discard it
+			fmt.Println("outbox relay err: discard row", rw.id, err)
+			done = append(done, rw.id)
+			continue
+		}
+		// listener of outbox is called around the real send
+		if _, sendErr = r.outbox.producerCore.Send(msgPusher{r.producer}, m); sendErr != nil {
+			break
+		}
+		done = append(done, rw.id)
+	}
+	if len(done) > 0 {
+		query = fmt.Sprintf("DELETE FROM %s WHERE id IN (%s)", r.outbox.table, d.placeholders(1, len(done)))
+		if _, err = tx.ExecContext(ctx, query, done...); err != nil {
+			return 0, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(done), sendErr
+}
@@ -2,8 +2,10 @@ package windy
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand"
+	"strconv"
 	"time"
 
 	"github.com/Visforest/goset/v2"
@@ -13,59 +15,442 @@ import (
 )
 
 var (
-	scriptFetchDelayMsgs = redis.NewScript(`return redis.call('zrange', KEYS[1], 0, ARGV[1], 'with score')`)
+	// moves delay msgs whose score is not greater than now from delay queue to queue in the order of score
+	scriptMoveReadyDelayMsgs = redis.NewScript(`
+local msgs = redis.call('zrangebyscore', KEYS[1], '-inf', ARGV[1], 'limit', 0, ARGV[2])
+for _, m in ipairs(msgs) do
+	redis.call('zrem', KEYS[1], m)
+	redis.call('lpush', KEYS[2], m)
+end
+return #msgs`)
+
+	// pops a msg from the first non-empty queue of KEYS[1..n], and keeps it in the processing queue KEYS[n+i] of queue KEYS[i]
+	// as '<delivery token ARGV[2]>:<msg>' until the visibility deadline ARGV[1], returns the msg and i-1
+	scriptReliableFetch = redis.NewScript(`
+local n = #KEYS / 2
+for i = 1, n do
+	local m = redis.call('rpop', KEYS[i])
+	if m then
+		redis.call('zadd', KEYS[n + i], ARGV[1], ARGV[2] .. ':' .. m)
+		return {m, i - 1}
+	end
+end
+return false`)
+
+	// moves msgs whose visibility deadline has passed from processing queue back to queue, without their delivery tokens.
+	// Msgs kept before delivery tokens were added have no token, they're moved as they are.
+	scriptRequeueExpired = redis.NewScript(`
+local msgs = redis.call('zrangebyscore', KEYS[1], '-inf', ARGV[1], 'limit', 0, ARGV[2])
+for _, m in ipairs(msgs) do
+	redis.call('zrem', KEYS[1], m)
+	local token = string.match(m, '^%x+:')
+	if token then
+		redis.call('rpush', KEYS[2], string.sub(m, #token + 1))
+	else
+		redis.call('rpush', KEYS[2], m)
+	end
+end
+return #msgs`)
+
+	// moves msg ARGV[2] kept as ARGV[1] in processing queue KEYS[1] back to the head of queue KEYS[2],
+	// unless it's been requeued after visibility timeout already, returns 1 if it's moved
+	scriptRequeue = redis.NewScript(`
+if redis.call('zrem', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('rpush', KEYS[2], ARGV[2])
+return 1`)
+
+	// moves the earliest dead letter ARGV[1] from dead-letter queue KEYS[1] to queue KEYS[2] as msg ARGV[2],
+	// unless it's been removed or redriven by others already, returns 1 if it's moved
+	scriptRedriveDeadLetter = redis.NewScript(`
+if redis.call('lindex', KEYS[1], -1) ~= ARGV[1] then
+	return 0
+end
+redis.call('rpop', KEYS[1])
+redis.call('lpush', KEYS[2], ARGV[2])
+return 1`)
+)
+
+const (
+	// the max duration to block on fetching msgs once
+	fetchBlockTimeout = time.Second
+	// the interval to poll queue in reliable mode when it's empty
+	reliablePollInterval = 100 * time.Millisecond
+	// the interval to requeue msgs whose visibility timeout expired
+	requeueInterval = time.Second
+	// the max count of msgs requeued once
+	requeueBatch = 100
+	// the max count of delay msgs moved to queue once
+	delayMsgsBatch = 100
 )
 
+// rDelivery is the ack token of msg fetched from redis
+type rDelivery struct {
+	payload  string // the msg as it's fetched
+	member   string // the member of msg in processing queue, '<delivery token>:<payload>', it's empty unless in reliable mode
+	priority int    // the priority of the queue msg is fetched from
+}
+
 // rClient is a client backed by redis, which implements core.Producer and core.Consumer
 type rClient struct {
-	ctx           context.Context
-	rds           *redis.Client
-	prefix        string
-	queueKey      string
-	delayQueueKey string
+	ctx                context.Context
+	rds                redis.UniversalClient
+	ownRds             bool // whether rds is created by windy and should be closed by windy
+	prefix             string
+	priorities         *rPriorities
+	deadLetterQueueKey string
+	replyKeyPrefix     string       // the prefix of reply list keys
+	replies            *rReplyInbox // only for producer
+	reliable           bool
+	visibilityTimeout  time.Duration
+	deadLetter         bool
+	encoder            core.MsgEncoder // the encoder with which msgs are encoded
+}
+
+func newRClient(ctx context.Context, rds redis.UniversalClient, cfg *RConf, encoder core.MsgEncoder) *rClient {
+	visibilityTimeout := cfg.VisibilityTimeout
+	if visibilityTimeout <= 0 {
+		visibilityTimeout = 60
+	}
+	cluster := isCluster(rds)
+	return &rClient{
+		ctx:                ctx,
+		rds:                rds,
+		prefix:             cfg.KeyPrefix,
+		priorities:         newRPriorities(cfg, cluster),
+		deadLetterQueueKey: redisKey(cfg.KeyPrefix, "dlq", cfg.Topic, cluster),
+		replyKeyPrefix:     redisKey(cfg.KeyPrefix, "reply", cfg.Topic, cluster),
+		reliable:           cfg.Reliable,
+		visibilityTimeout:  time.Duration(visibilityTimeout) * time.Second,
+		deadLetter:         cfg.DeadLetter,
+		encoder:            encoder,
+	}
+}
+
+// redisKey returns the redis key of the given kind for topic.
+// topic is hash-tagged on redis cluster, so that keys of the same topic are in the same slot,
+// and can be accessed by a lua script together. Keys aren't tagged otherwise, so that they're the same as before.
+func redisKey(prefix, kind, topic string, cluster bool) string {
+	if cluster {
+		return fmt.Sprintf("%s:%s:{%s}", prefix, kind, topic)
+	}
+	return fmt.Sprintf("%s:%s:%s", prefix, kind, topic)
+}
+
+// isCluster returns whether rds is a client of redis cluster
+func isCluster(rds redis.UniversalClient) bool {
+	_, ok := rds.(*redis.ClusterClient)
+	return ok
+}
+
+// newRedisClient returns a redis client by the url of a single node, or by the addresses of cluster or sentinel nodes.
+// It's a cluster client if cluster is set, even if there's only a seed address, otherwise it's a sentinel client
+// if masterName is set, or a cluster client if there're multi addresses.
+func newRedisClient(url string, addrs []string, masterName, username, password string, cluster bool) (redis.UniversalClient, error) {
+	if cluster {
+		if len(addrs) == 0 {
+			return nil, errors.New("addrs must be set for redis cluster")
+		}
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    addrs,
+			Username: username,
+			Password: password,
+		}), nil
+	}
+	if len(addrs) > 0 {
+		return redis.NewUniversalClient(&redis.UniversalOptions{
+			Addrs:      addrs,
+			MasterName: masterName,
+			Username:   username,
+			Password:   password,
+		}), nil
+	}
+	if url == "" {
+		return nil, errors.New("either url or addrs must be set")
+	}
+	redisOpts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return redis.NewClient(redisOpts), nil
+}
+
+// close closes redis client if it's created by windy
+func (c *rClient) close() error {
+	c.replies.close()
+	if !c.ownRds {
+		return nil
+	}
+	return c.rds.Close()
 }
 
 func (c *rClient) Push(m *core.Msg) error {
-	val, err := json.Marshal(m)
+	val, err := c.encoder.Encode(m)
 	if err != nil {
 		return err
 	}
+	priority := c.priorities.of(m)
 	if m.DelayAt != nil {
 		// delay msg
-		err = c.rds.ZAdd(c.ctx, c.delayQueueKey, redis.Z{
-			Score:  float64(m.DelayAt.Unix()),
+		err = c.rds.ZAdd(c.ctx, c.priorities.delayQueueKeys[priority], redis.Z{
+			Score:  float64(m.DelayAt.UnixMilli()),
 			Member: string(val),
 		}).Err()
 	} else {
 		// normal msg
-		err = c.rds.LPush(c.ctx, c.queueKey, string(val)).Err()
+		err = c.rds.LPush(c.ctx, c.priorities.queueKeys[priority], string(val)).Err()
 	}
 	return err
 }
 
-func (c *rClient) Fetch() (*core.Msg, error) {
-	vals, err := c.rds.BRPop(c.ctx, 0, c.queueKey).Result()
+// PushBatch sends normal msgs by a LPUSH and delay msgs by a ZADD of each priority in a pipeline
+func (c *rClient) PushBatch(ms []*core.Msg) []error {
+	errs := make([]error, len(ms))
+	n := len(c.priorities.queueKeys)
+	normal, delay := make([][]int, n), make([][]int, n) // indexes of normal msgs and delay msgs of each priority
+	vals := make([][]any, n)
+	zs := make([][]redis.Z, n)
+	for i, m := range ms {
+		val, err := c.encoder.Encode(m)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		priority := c.priorities.of(m)
+		if m.DelayAt != nil {
+			delay[priority] = append(delay[priority], i)
+			zs[priority] = append(zs[priority], redis.Z{Score: float64(m.DelayAt.UnixMilli()), Member: string(val)})
+		} else {
+			normal[priority] = append(normal[priority], i)
+			vals[priority] = append(vals[priority], string(val))
+		}
+	}
+	pipe := c.rds.Pipeline()
+	pushCmds, addCmds := make([]*redis.IntCmd, n), make([]*redis.IntCmd, n)
+	for p := 0; p < n; p++ {
+		if len(vals[p]) > 0 {
+			pushCmds[p] = pipe.LPush(c.ctx, c.priorities.queueKeys[p], vals[p]...)
+		}
+		if len(zs[p]) > 0 {
+			addCmds[p] = pipe.ZAdd(c.ctx, c.priorities.delayQueueKeys[p], zs[p]...)
+		}
+	}
+	if pipe.Len() > 0 {
+		_, _ = pipe.Exec(c.ctx)
+	}
+	for p := 0; p < n; p++ {
+		if pushCmds[p] != nil {
+			setErrs(errs, normal[p], pushCmds[p].Err())
+		}
+		if addCmds[p] != nil {
+			setErrs(errs, delay[p], addCmds[p].Err())
+		}
+	}
+	return batchErrs(errs)
+}
+
+// setErrs sets err as the errors of msgs of indexes
+func setErrs(errs []error, indexes []int, err error) {
+	for _, i := range indexes {
+		errs[i] = err
+	}
+}
+
+// batchErrs returns nil if there's no error in errs, otherwise errs
+func batchErrs(errs []error) []error {
+	for _, err := range errs {
+		if err != nil {
+			return errs
+		}
+	}
+	return nil
+}
+
+func (c *rClient) Fetch(ctx context.Context) (*core.Msg, error) {
+	if c.reliable {
+		return c.reliableFetch(ctx)
+	}
+	var vals []string
+	for {
+		var err error
+		order := c.priorities.fetchOrder()
+		keys := make([]string, len(order))
+		for i, p := range order {
+			keys[i] = c.priorities.queueKeys[p]
+		}
+		// block for a limited time so that ctx is checked in time, BRPOP pops from the first non-empty queue of keys
+		vals, err = c.rds.BRPop(ctx, fetchBlockTimeout, keys...).Result()
+		if err == redis.Nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	m, err := core.DecodeMsgFromStr(vals[1])
 	if err != nil {
+		c.discard(rDelivery{payload: vals[1]}, err)
 		return nil, err
 	}
-	return core.DecodeMsgFromStr(vals[1])
+	m.SetAckToken(rDelivery{payload: vals[1]})
+	return m, nil
 }
 
-func (c *rClient) FetchDelayMsgs() ([]*core.Msg, error) {
-	r, err := scriptFetchDelayMsgs.Eval(c.ctx, c.rds, []string{c.delayQueueKey}, []int64{time.Now().Unix()}).Result()
+// discard drops bad msg delivered which can't be decoded, it's sent to dead-letter queue if enabled
+func (c *rClient) discard(d rDelivery, reason error) {
+	if c.deadLetter {
+		if err := c.pushDeadLetter(core.NewDeadLetter(nil, []byte(d.payload), reason)); err != nil {
+			fmt.Println("dead letter err:", err)
+		}
+	}
+	if d.member != "" {
+		if err := c.rds.ZRem(c.ctx, c.priorities.processingQueueKeys[d.priority], d.member).Err(); err != nil {
+			fmt.Println("discard err:", err)
+		}
+	}
+}
+
+// DeadLetter sends msg to dead-letter queue if enabled
+func (c *rClient) DeadLetter(m *core.Msg, reason error) (bool, error) {
+	if !c.deadLetter {
+		return false, nil
+	}
+	var payload string
+	if d, ok := m.AckToken().(rDelivery); ok {
+		payload = d.payload
+	} else {
+		val, err := c.encoder.Encode(m)
+		if err != nil {
+			return false, err
+		}
+		payload = string(val)
+	}
+	if err := c.pushDeadLetter(core.NewDeadLetter(m, []byte(payload), reason)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (c *rClient) pushDeadLetter(d *core.DeadLetter) error {
+	val, err := d.Encode()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	resultMsgStrs := r.([]string)
-	msgs := make([]*core.Msg, len(resultMsgStrs))
-	for i, msgStr := range resultMsgStrs {
-		m, err := core.DecodeMsgFromStr(msgStr)
+	return c.rds.LPush(c.ctx, c.deadLetterQueueKey, string(val)).Err()
+}
+
+// reliableFetch blocks until a msg is moved from queue to processing queue.
+// Msg is kept with a token of its delivery, so that the copy of it redelivered isn't removed by the late ack of this one.
+func (c *rClient) reliableFetch(ctx context.Context) (*core.Msg, error) {
+	for {
+		deadline := time.Now().Add(c.visibilityTimeout).UnixMilli()
+		token := strconv.FormatUint(rand.Uint64(), 16)
+		order := c.priorities.fetchOrder()
+		keys := make([]string, 2*len(order))
+		for i, p := range order {
+			keys[i] = c.priorities.queueKeys[p]
+			keys[len(order)+i] = c.priorities.processingQueueKeys[p]
+		}
+		res, err := scriptReliableFetch.Run(ctx, c.rds, keys, deadline, token).Slice()
+		if err == redis.Nil {
+			// queue is empty
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(reliablePollInterval):
+				continue
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		val, _ := res[0].(string)
+		i, _ := res[1].(int64)
+		d := rDelivery{payload: val, member: token + ":" + val, priority: order[i]}
+		m, err := core.DecodeMsgFromStr(val)
 		if err != nil {
+			// bad msg will never be consumed successfully, don't redeliver it
+			c.discard(d, err)
 			return nil, err
 		}
-		msgs[i] = m
+		m.Priority = d.priority
+		m.SetAckToken(d)
+		return m, nil
+	}
+}
+
+// Ack removes the delivery of msg from processing queue, the copy redelivered after visibility timeout isn't affected
+func (c *rClient) Ack(m *core.Msg) error {
+	d, ok := m.AckToken().(rDelivery)
+	if !c.reliable || !ok || d.member == "" {
+		return nil
+	}
+	return c.rds.ZRem(c.ctx, c.priorities.processingQueueKeys[d.priority], d.member).Err()
+}
+
+// Nack moves msg from processing queue back to the head of queue, so that it's redelivered at once,
+// unless it's been requeued after visibility timeout already
+func (c *rClient) Nack(m *core.Msg, err error) error {
+	d, ok := m.AckToken().(rDelivery)
+	if !c.reliable || !ok || d.member == "" {
+		return nil
+	}
+	keys := []string{c.priorities.processingQueueKeys[d.priority], c.priorities.queueKeys[d.priority]}
+	return scriptRequeue.Run(c.ctx, c.rds, keys, d.member, d.payload).Err()
+}
+
+// requeueExpired moves msgs of priority whose visibility timeout expired back to queue, returns the count of msgs moved
+func (c *rClient) requeueExpired(priority int) (int64, error) {
+	keys := []string{c.priorities.processingQueueKeys[priority], c.priorities.queueKeys[priority]}
+	return scriptRequeueExpired.Run(c.ctx, c.rds, keys, time.Now().UnixMilli(), requeueBatch).Int64()
+}
+
+// loopRequeueExpired requeues msgs whose visibility timeout expired in loop until ctx is done
+func (c *rClient) loopRequeueExpired(ctx context.Context) {
+	ticker := time.NewTicker(requeueInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for p := range c.priorities.processingQueueKeys {
+				for {
+					n, err := c.requeueExpired(p)
+					if err != nil {
+						fmt.Println("requeueExpired err:", err)
+						break
+					}
+					if n < requeueBatch {
+						break
+					}
+				}
+			}
+		}
 	}
-	return msgs, nil
+}
+
+// FetchDelayMsgs moves ready delay msgs to queue atomically, so it's safe to be called by many consumers at the same time.
+// The ready msgs will be fetched by Fetch, so it always returns no msg.
+func (c *rClient) FetchDelayMsgs() ([]*core.Msg, error) {
+	for p := range c.priorities.delayQueueKeys {
+		keys := []string{c.priorities.delayQueueKeys[p], c.priorities.queueKeys[p]}
+		for {
+			n, err := scriptMoveReadyDelayMsgs.Run(c.ctx, c.rds, keys, time.Now().UnixMilli(), delayMsgsBatch).Int64()
+			if err != nil {
+				return nil, err
+			}
+			if n < delayMsgsBatch {
+				break
+			}
+		}
+	}
+	return nil, nil
 }
 
 type RProducer struct {
@@ -75,29 +460,34 @@ type RProducer struct {
 
 // NewRProducer returns a producer and an error
 func NewRProducer(cfg *RConf, opts ...core.ProducerOption) (*RProducer, error) {
-	redisOpts, err := redis.ParseURL(cfg.Url)
+	if err := checkPriorityConf(cfg); err != nil {
+		return nil, err
+	}
+	rds, err := newRedisClient(cfg.Url, cfg.Addrs, cfg.MasterName, cfg.Username, cfg.Password, cfg.Cluster)
 	if err != nil {
 		return nil, err
 	}
+	producer := NewRProducerWithClient(rds, cfg, opts...)
+	producer.client.ownRds = true
+	return producer, nil
+}
+
+// NewRProducerWithClient returns a producer which uses the specified redis client, the connection configuration of cfg is ignored
+func NewRProducerWithClient(rds redis.UniversalClient, cfg *RConf, opts ...core.ProducerOption) *RProducer {
 	producerCore := &core.ProducerCore{
 		Ctx:       context.Background(),
 		Topic:     cfg.Topic,
-		IdCreator: core.NewSnowflakeCreator(1),
+		IdCreator: core.DefaultIdCreator,
 	}
 	for _, opt := range opts {
 		opt(producerCore)
 	}
-	client := &rClient{
-		ctx:           producerCore.Ctx,
-		rds:           redis.NewClient(redisOpts),
-		prefix:        cfg.KeyPrefix,
-		queueKey:      fmt.Sprintf("%s:queue:%s", cfg.KeyPrefix, cfg.Topic),
-		delayQueueKey: fmt.Sprintf("%s:delayqueue:%s", cfg.KeyPrefix, cfg.Topic),
-	}
+	client := newRClient(producerCore.Ctx, rds, cfg, producerCore.MsgEncoder())
+	client.replies = newRReplyInbox(client.ctx, rds, client.replyKeyPrefix, producerCore.IdCreator.Create())
 	return &RProducer{
 		producerCore: producerCore,
 		client:       client,
-	}, nil
+	}
 }
 
 // MustNewRProducer returns a producer or panic if fails
@@ -113,17 +503,61 @@ func (p *RProducer) Send(data any, opts ...core.MsgOption) (string, error) {
 	return p.producerCore.Send(p.client, core.NewMsg(data, opts...))
 }
 
+// SendMsg sends msg as it is, msg id is kept if it's set
+func (p *RProducer) SendMsg(m *core.Msg) (string, error) {
+	return p.producerCore.Send(p.client, m)
+}
+
+// Request sends data as a request, and blocks until its reply is received or ctx is done
+func (p *RProducer) Request(ctx context.Context, data any, opts ...core.MsgOption) (*core.Msg, error) {
+	return p.producerCore.Request(ctx, p.client, p.client, core.NewMsg(data, opts...))
+}
+
+// SendBatch sends data items to message queue in a round-trip, ids are returned in order, and the id of item failed to be sent is empty.
+// If some items are failed to be sent, a *core.BatchError is returned.
+func (p *RProducer) SendBatch(items []any, opts ...core.MsgOption) ([]string, error) {
+	return p.producerCore.SendBatch(p.client, core.NewMsgs(items, opts...))
+}
+
+// SendAsync buffers data and returns msg id, msg is sent in background and the result is reported by listener.
+// It blocks if the buffer is full, and returns core.ErrProducerClosed after producer is closed.
+func (p *RProducer) SendAsync(data any, opts ...core.MsgOption) (string, error) {
+	return p.producerCore.SendAsync(p.client, core.NewMsg(data, opts...))
+}
+
+// Flush blocks until the msgs buffered by SendAsync before are sent or ctx is done
+func (p *RProducer) Flush(ctx context.Context) error {
+	return p.producerCore.Flush(ctx)
+}
+
+// Close sends all the msgs buffered by SendAsync, and then closes the connection unless the redis client is specified by you.
+// If ctx is done earlier, the buffered msgs are still sent in background and the connection is closed after that.
+func (p *RProducer) Close(ctx context.Context) error {
+	return p.producerCore.Close(ctx, p.client.close)
+}
+
 type RConsumer struct {
 	consumerCore *core.ConsumerCore
 	client       *rClient
+	stop         context.CancelFunc
 }
 
 // NewRConsumer returns a consumer and error
 func NewRConsumer(cfg *RConf, handler core.ConsumeFunc, opts ...core.ConsumerOption) (*RConsumer, error) {
-	redisOpts, err := redis.ParseURL(cfg.Url)
+	if err := checkPriorityConf(cfg); err != nil {
+		return nil, err
+	}
+	rds, err := newRedisClient(cfg.Url, cfg.Addrs, cfg.MasterName, cfg.Username, cfg.Password, cfg.Cluster)
 	if err != nil {
 		return nil, err
 	}
+	consumer := NewRConsumerWithClient(rds, cfg, handler, opts...)
+	consumer.client.ownRds = true
+	return consumer, nil
+}
+
+// NewRConsumerWithClient returns a consumer which uses the specified redis client, the connection configuration of cfg is ignored
+func NewRConsumerWithClient(rds redis.UniversalClient, cfg *RConf, handler core.ConsumeFunc, opts ...core.ConsumerOption) *RConsumer {
 	var batchProcess *BatchProcessConf
 	if cfg.BatchProcess == nil {
 		batchProcess = &BatchProcessConf{}
@@ -142,18 +576,12 @@ func NewRConsumer(cfg *RConf, handler core.ConsumeFunc, opts ...core.ConsumerOpt
 	for _, opt := range opts {
 		opt(consumerCore)
 	}
-	client := &rClient{
-		ctx:           consumerCore.Ctx,
-		rds:           redis.NewClient(redisOpts),
-		prefix:        cfg.KeyPrefix,
-		queueKey:      fmt.Sprintf("%s:queue:%s", cfg.KeyPrefix, cfg.Topic),
-		delayQueueKey: fmt.Sprintf("%s:delayqueue:%s", cfg.KeyPrefix, cfg.Topic),
-	}
+	client := newRClient(consumerCore.Ctx, rds, cfg, consumerCore.MsgEncoder())
 
 	return &RConsumer{
 		consumerCore: consumerCore,
 		client:       client,
-	}, nil
+	}
 }
 
 // MustNewRConsumer returns a consumer, if it fails, panic
@@ -165,6 +593,128 @@ func MustNewRConsumer(cfg *RConf, handler core.ConsumeFunc, opts ...core.Consume
 	return consumer
 }
 
+// LoopConsume blocks and consumes msgs in loop with multi goroutine, until it gets a quit signal
 func (c *RConsumer) LoopConsume() {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	if c.client.reliable {
+		go c.client.loopRequeueExpired(ctx)
+	}
 	c.consumerCore.LoopConsume(c.client)
 }
+
+// Start starts to consume msgs in background, msgs are fetched until ctx is done or Shutdown is called
+func (c *RConsumer) Start(ctx context.Context) error {
+	ctx, stop := context.WithCancel(ctx)
+	if err := c.consumerCore.Start(ctx, c.client); err != nil {
+		stop()
+		return err
+	}
+	// kept only if started, so that starting twice doesn't lose the stop of the running one
+	c.stop = stop
+	if c.client.reliable {
+		go c.client.loopRequeueExpired(ctx)
+	}
+	return nil
+}
+
+// Shutdown stops fetching msgs, waits until the fetched ones are consumed and acknowledged or ctx is done,
+// and then closes the connection unless the redis client is specified by you.
+// In reliable mode, the msgs unacknowledged will be redelivered.
+func (c *RConsumer) Shutdown(ctx context.Context) error {
+	err := c.consumerCore.Shutdown(ctx)
+	if c.stop != nil {
+		c.stop()
+	}
+	return errors.Join(err, c.client.close())
+}
+
+// DeadLetters returns at most limit dead letters from offset, the latest first
+func (c *RConsumer) DeadLetters(offset, limit int64) ([]*core.DeadLetter, error) {
+	vals, err := c.client.rds.LRange(c.client.ctx, c.client.deadLetterQueueKey, offset, offset+limit-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]*core.DeadLetter, len(vals))
+	for i, val := range vals {
+		if letters[i], err = core.DecodeDeadLetter([]byte(val)); err != nil {
+			return nil, err
+		}
+	}
+	return letters, nil
+}
+
+// DeadLetter returns the dead letter of msg id, or nil if it's missing
+func (c *RConsumer) DeadLetter(id string) (*core.DeadLetter, error) {
+	const batch = 100
+	for offset := int64(0); ; offset += batch {
+		letters, err := c.DeadLetters(offset, batch)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range letters {
+			if d.Id == id {
+				return d, nil
+			}
+		}
+		if len(letters) < batch {
+			return nil, nil
+		}
+	}
+}
+
+// PurgeDeadLetters removes all the dead letters, returns the count of removed ones
+func (c *RConsumer) PurgeDeadLetters() (int64, error) {
+	var n *redis.IntCmd
+	_, err := c.client.rds.TxPipelined(c.client.ctx, func(pipe redis.Pipeliner) error {
+		n = pipe.LLen(c.client.ctx, c.client.deadLetterQueueKey)
+		pipe.Del(c.client.ctx, c.client.deadLetterQueueKey)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n.Val(), nil
+}
+
+// RedriveDeadLetters sends at most n dead letters back to queue, the earliest first, returns the count of redriven ones
+func (c *RConsumer) RedriveDeadLetters(n int64) (int64, error) {
+	var redriven int64
+	for redriven < n {
+		val, err := c.client.rds.LIndex(c.client.ctx, c.client.deadLetterQueueKey, -1).Result()
+		if err == redis.Nil {
+			break
+		}
+		if err != nil {
+			return redriven, err
+		}
+		moved, err := c.redrive(val)
+		if err != nil {
+			// the dead letter is kept in dead-letter queue
+			return redriven, err
+		}
+		if moved {
+			redriven++
+		}
+	}
+	return redriven, nil
+}
+
+// redrive moves the earliest dead letter val to queue atomically, it returns false if val isn't the earliest one any more
+func (c *RConsumer) redrive(val string) (bool, error) {
+	d, err := core.DecodeDeadLetter([]byte(val))
+	if err != nil {
+		return false, err
+	}
+	m, err := d.Msg()
+	if err != nil {
+		return false, err
+	}
+	payload, err := c.client.encoder.Encode(m)
+	if err != nil {
+		return false, err
+	}
+	keys := []string{c.client.deadLetterQueueKey, c.client.priorities.queueKeys[c.client.priorities.of(m)]}
+	moved, err := scriptRedriveDeadLetter.Run(c.client.ctx, c.client.rds, keys, val, string(payload)).Int()
+	return moved == 1, err
+}
@@ -0,0 +1,106 @@
+package windy
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/visforest/windy/core"
+)
+
+// rPriorities keeps the queues of msg priorities of rClient, the queues of priority 0 are the ones without priority
+type rPriorities struct {
+	queueKeys           []string // indexed by priority
+	delayQueueKeys      []string
+	processingQueueKeys []string
+	weighted            bool
+	weights             []int
+	totalWeight         int
+}
+
+func newRPriorities(cfg *RConf, cluster bool) *rPriorities {
+	n := cfg.Priorities
+	if n <= 0 {
+		n = 1
+	}
+	p := &rPriorities{
+		queueKeys:           make([]string, n),
+		delayQueueKeys:      make([]string, n),
+		processingQueueKeys: make([]string, n),
+		weighted:            cfg.PriorityMode == PriorityWeighted,
+		weights:             make([]int, n),
+	}
+	for i := 0; i < n; i++ {
+		p.queueKeys[i] = priorityKey(redisKey(cfg.KeyPrefix, "queue", cfg.Topic, cluster), i)
+		p.delayQueueKeys[i] = priorityKey(redisKey(cfg.KeyPrefix, "delayqueue", cfg.Topic, cluster), i)
+		p.processingQueueKeys[i] = priorityKey(redisKey(cfg.KeyPrefix, "processing", cfg.Topic, cluster), i)
+		p.weights[i] = i + 1
+		if i < len(cfg.PriorityWeights) && cfg.PriorityWeights[i] > 0 {
+			p.weights[i] = cfg.PriorityWeights[i]
+		}
+		p.totalWeight += p.weights[i]
+	}
+	return p
+}
+
+// checkPriorityConf returns an error if priority configuration of cfg is invalid
+func checkPriorityConf(cfg *RConf) error {
+	switch cfg.PriorityMode {
+	case "", PriorityStrict, PriorityWeighted:
+	default:
+		return fmt.Errorf("unsupported priority mode '%s'", cfg.PriorityMode)
+	}
+	for _, w := range cfg.PriorityWeights {
+		if w < 0 {
+			return fmt.Errorf("priority weight %d must not be negative", w)
+		}
+	}
+	return nil
+}
+
+// priorityKey returns the key of priority for key, the key of priority 0 is key itself to be compatible with msgs without priority
+func priorityKey(key string, priority int) string {
+	if priority == 0 {
+		return key
+	}
+	return fmt.Sprintf("%s:%d", key, priority)
+}
+
+// of returns the priority of msg clamped into the priorities supported
+func (p *rPriorities) of(m *core.Msg) int {
+	if m.Priority <= 0 {
+		return 0
+	}
+	if m.Priority >= len(p.queueKeys) {
+		return len(p.queueKeys) - 1
+	}
+	return m.Priority
+}
+
+// fetchOrder returns the priorities in the order in which their queues are fetched.
+// It's from the highest to the lowest in strict mode, and is a shuffle weighted by weights in weighted mode,
+// so that each priority comes first at the share of its weight.
+func (p *rPriorities) fetchOrder() []int {
+	n := len(p.queueKeys)
+	order := make([]int, n)
+	for i := range order {
+		order[i] = n - 1 - i
+	}
+	if !p.weighted || n == 1 {
+		return order
+	}
+	total := p.totalWeight
+	for i := 0; i < n-1; i++ {
+		// pick one from order[i:] by weight
+		r := rand.Intn(total)
+		for j := i; j < n; j++ {
+			w := p.weights[order[j]]
+			if r < w {
+				order[i], order[j] = order[j], order[i]
+				break
+			}
+			r -= w
+		}
+		total -= p.weights[order[i]]
+	}
+	return order
+}
@@ -0,0 +1,139 @@
+package windy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"github.com/visforest/windy/core"
+	"sync"
+	"time"
+)
+
+// the TTL of reply lists, so that the replies which are never received are removed
+const replyTTL = 5 * time.Minute
+
+// pushRedisReply sends reply to the list of replyTo
+func pushRedisReply(ctx context.Context, rds redis.UniversalClient, encoder core.MsgEncoder, replyTo string, reply *core.Msg) error {
+	val, err := encoder.Encode(reply)
+	if err != nil {
+		return err
+	}
+	pipe := rds.TxPipeline()
+	pipe.LPush(ctx, replyTo, string(val))
+	pipe.Expire(ctx, replyTo, replyTTL)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// rReplyInbox receives replies from the inbox list of a producer, and dispatches them to the requests waiting by correlation id,
+// so that a producer blocks only a connection to receive replies no matter how many requests are waiting.
+type rReplyInbox struct {
+	ctx     context.Context
+	rds     redis.UniversalClient
+	key     string // '<key_prefix>:reply:{<topic>}:<inbox id>'
+	mu      sync.Mutex
+	waiters map[string]chan *core.Msg
+	stop    context.CancelFunc // stops receiving replies, it's nil until the first request
+	done    chan struct{}      // closed after receiving quits
+}
+
+// newRReplyInbox returns an inbox of list '<keyPrefix>:<inbox id>', id must be unique among all the producers of topic
+func newRReplyInbox(ctx context.Context, rds redis.UniversalClient, keyPrefix, id string) *rReplyInbox {
+	return &rReplyInbox{
+		ctx:     ctx,
+		rds:     rds,
+		key:     keyPrefix + ":" + id,
+		waiters: make(map[string]chan *core.Msg),
+	}
+}
+
+// subscribe starts to receive replies if it hasn't, and waits for the reply of correlation id
+func (b *rReplyInbox) subscribe(correlationId string) (string, <-chan *core.Msg, func(), error) {
+	if b == nil {
+		return "", nil, nil, errors.New("request is only supported by producer")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stop == nil {
+		ctx, stop := context.WithCancel(b.ctx)
+		b.stop = stop
+		b.done = make(chan struct{})
+		go b.receive(ctx, b.done)
+	}
+	replies := make(chan *core.Msg, 1)
+	b.waiters[correlationId] = replies
+	return b.key, replies, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.waiters, correlationId)
+	}, nil
+}
+
+// receive receives replies in loop and dispatches them until ctx is done, and then closes done
+func (b *rReplyInbox) receive(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	for ctx.Err() == nil {
+		// block for a limited time so that ctx is checked in time
+		vals, err := b.rds.BRPop(ctx, fetchBlockTimeout, b.key).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Println("reply err:", err)
+				time.Sleep(reliablePollInterval)
+			}
+			continue
+		}
+		m, err := core.DecodeMsgFromStr(vals[1])
+		if err != nil {
+			fmt.Println("reply err:", err)
+			continue
+		}
+		// the replies of requests which have given up are dropped
+		b.mu.Lock()
+		if replies, ok := b.waiters[m.CorrelationId]; ok {
+			select {
+			case replies <- m:
+			default:
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+// close stops receiving replies, and waits until receiving quits so that redis client can be closed then
+func (b *rReplyInbox) close() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	stop, done := b.stop, b.done
+	b.stop = nil
+	b.mu.Unlock()
+	if stop != nil {
+		stop()
+		<-done
+	}
+}
+
+// Subscribe receives the reply of correlation id from the inbox list '<key_prefix>:reply:{<topic>}:<inbox id>' of producer
+func (c *rClient) Subscribe(correlationId string) (string, <-chan *core.Msg, func(), error) {
+	return c.replies.subscribe(correlationId)
+}
+
+// Reply sends reply to the list of replyTo
+func (c *rClient) Reply(replyTo string, reply *core.Msg) error {
+	return pushRedisReply(c.ctx, c.rds, c.encoder, replyTo, reply)
+}
+
+// Subscribe receives the reply of correlation id from the inbox list '<key_prefix>:reply:{<topic>}:<inbox id>' of producer
+func (c *sClient) Subscribe(correlationId string) (string, <-chan *core.Msg, func(), error) {
+	return c.replies.subscribe(correlationId)
+}
+
+// Reply sends reply to the list of replyTo
+func (c *sClient) Reply(replyTo string, reply *core.Msg) error {
+	return pushRedisReply(c.ctx, c.rds, c.encoder, replyTo, reply)
+}
@@ -0,0 +1,114 @@
+package windy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RDedupStore is a core.DedupStore backed by redis, keys are stored as '<key_prefix>:dedup:<topic>:<key>' with window as TTL,
+// and the id of msg that sees the key first as value.
+// Keys aren't hash-tagged, so that they spread over the slots of redis cluster.
+type RDedupStore struct {
+	rds    redis.UniversalClient
+	prefix string
+}
+
+// NewRDedupStore returns a dedup store and an error
+func NewRDedupStore(cfg *RConf) (*RDedupStore, error) {
+	rds, err := newRedisClient(cfg.Url, cfg.Addrs, cfg.MasterName, cfg.Username, cfg.Password, cfg.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	return NewRDedupStoreWithClient(rds, cfg.KeyPrefix), nil
+}
+
+// NewRDedupStoreWithClient returns a dedup store which uses the specified redis client
+func NewRDedupStoreWithClient(rds redis.UniversalClient, keyPrefix string) *RDedupStore {
+	return &RDedupStore{
+		rds:    rds,
+		prefix: keyPrefix,
+	}
+}
+
+// MustNewRDedupStore returns a dedup store or panic if fails
+func MustNewRDedupStore(cfg *RConf) *RDedupStore {
+	store, err := NewRDedupStore(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return store
+}
+
+// scriptSeen sets KEYS[1] to msg id ARGV[1] with TTL ARGV[2] in milliseconds if it's missing, it never expires if TTL is 0.
+// It returns 1 if it's set by another msg, or by any msg if ARGV[1] is empty
+var scriptSeen = redis.NewScript(`
+local v = redis.call('get', KEYS[1])
+if not v then
+	if tonumber(ARGV[2]) > 0 then
+		redis.call('set', KEYS[1], ARGV[1], 'px', ARGV[2])
+	else
+		redis.call('set', KEYS[1], ARGV[1])
+	end
+	return 0
+end
+if ARGV[1] ~= '' and v == ARGV[1] then
+	return 0
+end
+return 1`)
+
+func (s *RDedupStore) Seen(ctx context.Context, topic, key, id string, window time.Duration) (bool, error) {
+	key = fmt.Sprintf("%s:dedup:%s:%s", s.prefix, topic, key)
+	seen, err := scriptSeen.Run(ctx, s.rds, []string{key}, id, window.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	return seen == 1, nil
+}
+
+// RIdempotencyStore is a core.IdempotencyStore backed by redis, ids are stored as '<key_prefix>:done:<topic>:<id>'.
+// Keys aren't hash-tagged, so that they spread over the slots of redis cluster.
+type RIdempotencyStore struct {
+	rds    redis.UniversalClient
+	prefix string
+}
+
+// NewRIdempotencyStore returns an idempotency store and an error
+func NewRIdempotencyStore(cfg *RConf) (*RIdempotencyStore, error) {
+	rds, err := newRedisClient(cfg.Url, cfg.Addrs, cfg.MasterName, cfg.Username, cfg.Password, cfg.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	return NewRIdempotencyStoreWithClient(rds, cfg.KeyPrefix), nil
+}
+
+// NewRIdempotencyStoreWithClient returns an idempotency store which uses the specified redis client
+func NewRIdempotencyStoreWithClient(rds redis.UniversalClient, keyPrefix string) *RIdempotencyStore {
+	return &RIdempotencyStore{
+		rds:    rds,
+		prefix: keyPrefix,
+	}
+}
+
+// MustNewRIdempotencyStore returns an idempotency store or panic if fails
+func MustNewRIdempotencyStore(cfg *RConf) *RIdempotencyStore {
+	store, err := NewRIdempotencyStore(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return store
+}
+
+func (s *RIdempotencyStore) IsDone(ctx context.Context, topic, id string) (bool, error) {
+	n, err := s.rds.Exists(ctx, fmt.Sprintf("%s:done:%s:%s", s.prefix, topic, id)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (s *RIdempotencyStore) MarkDone(ctx context.Context, topic, id string, ttl time.Duration) error {
+	return s.rds.Set(ctx, fmt.Sprintf("%s:done:%s:%s", s.prefix, topic, id), 1, ttl).Err()
+}
@@ -0,0 +1,505 @@
+package windy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Visforest/goset/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/visforest/windy/core"
+)
+
+var (
+	// moves delay msgs whose score is not greater than now from delay queue to stream in the order of score,
+	// ARGV[3] and ARGV[4] are the trimming strategy and threshold of stream, which are ignored if ARGV[3] is empty
+	scriptMoveReadyDelayMsgsToStream = redis.NewScript(`
+local msgs = redis.call('zrangebyscore', KEYS[1], '-inf', ARGV[1], 'limit', 0, ARGV[2])
+for _, m in ipairs(msgs) do
+	redis.call('zrem', KEYS[1], m)
+	if ARGV[3] ~= '' then
+		redis.call('xadd', KEYS[2], ARGV[3], '~', ARGV[4], '*', 'msg', m)
+	else
+		redis.call('xadd', KEYS[2], '*', 'msg', m)
+	end
+end
+return #msgs`)
+)
+
+const (
+	// the field of stream entry that keeps msg
+	streamMsgField = "msg"
+	// the max count of pending entries claimed once
+	claimBatch = 100
+)
+
+// sClient is a client backed by redis stream, which implements core.Producer and core.Consumer
+type sClient struct {
+	ctx            context.Context
+	rds            redis.UniversalClient
+	ownRds         bool // whether rds is created by windy and should be closed by windy
+	streamKey      string
+	delayQueueKey  string
+	replyKeyPrefix string       // the prefix of reply list keys
+	replies        *rReplyInbox // only for producer
+	maxLen         int64
+	retention      time.Duration
+	encoder        core.MsgEncoder // the encoder with which msgs are encoded
+
+	// only for consumer
+	group          string
+	consumer       string
+	retryStreamKey string // the stream of msgs retried by group, which is read by group only
+	retryQueueKey  string // the delay queue of msgs retried by group
+	claimIdle      time.Duration
+	claimMu        sync.Mutex
+	claimStarts    map[string]string // the cursors of XAUTOCLAIM of streams
+	lastClaimAt    time.Time         // the last time to claim pending entries
+	buffered       []sEntry          // claimed and read entries waiting to be fetched
+}
+
+// sEntry is an entry of stream, it's the ack token of msg
+type sEntry struct {
+	stream string
+	redis.XMessage
+}
+
+func newSClient(ctx context.Context, rds redis.UniversalClient, cfg *SConf, encoder core.MsgEncoder) *sClient {
+	claimIdle := cfg.ClaimIdle
+	if claimIdle <= 0 {
+		claimIdle = 60
+	}
+	consumer := cfg.Consumer
+	if consumer == "" {
+		hostname, _ := os.Hostname()
+		consumer = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	cluster := isCluster(rds)
+	c := &sClient{
+		ctx:            ctx,
+		rds:            rds,
+		streamKey:      redisKey(cfg.KeyPrefix, "stream", cfg.Topic, cluster),
+		delayQueueKey:  redisKey(cfg.KeyPrefix, "streamdelayqueue", cfg.Topic, cluster),
+		replyKeyPrefix: redisKey(cfg.KeyPrefix, "reply", cfg.Topic, cluster),
+		maxLen:         cfg.MaxLen,
+		retention:      time.Duration(cfg.Retention) * time.Second,
+		group:          cfg.Group,
+		consumer:       consumer,
+		claimIdle:      time.Duration(claimIdle) * time.Second,
+		encoder:        encoder,
+	}
+	if cfg.Group != "" {
+		c.retryStreamKey = redisKey(cfg.KeyPrefix, "streamretry:"+cfg.Group, cfg.Topic, cluster)
+		c.retryQueueKey = redisKey(cfg.KeyPrefix, "streamretrydelay:"+cfg.Group, cfg.Topic, cluster)
+		c.claimStarts = map[string]string{c.streamKey: "0-0", c.retryStreamKey: "0-0"}
+	}
+	return c
+}
+
+// streams returns the streams read by group
+func (c *sClient) streams() []string {
+	return []string{c.streamKey, c.retryStreamKey}
+}
+
+// trimArgs returns the trimming strategy and threshold of stream, MAXLEN takes precedence over MINID
+func (c *sClient) trimArgs() (string, string) {
+	if c.maxLen > 0 {
+		return "MAXLEN", fmt.Sprintf("%d", c.maxLen)
+	}
+	if c.retention > 0 {
+		return "MINID", fmt.Sprintf("%d", time.Now().Add(-c.retention).UnixMilli())
+	}
+	return "", ""
+}
+
+// close closes redis client if it's created by windy
+func (c *sClient) close() error {
+	c.replies.close()
+	if !c.ownRds {
+		return nil
+	}
+	return c.rds.Close()
+}
+
+func (c *sClient) Push(m *core.Msg) error {
+	val, err := c.encoder.Encode(m)
+	if err != nil {
+		return err
+	}
+	if m.DelayAt != nil && m.DelayAt.After(time.Now()) {
+		// delay msg
+		return c.rds.ZAdd(c.ctx, c.delayQueueKey, redis.Z{
+			Score:  float64(m.DelayAt.UnixMilli()),
+			Member: string(val),
+		}).Err()
+	}
+	// normal msg
+	return c.rds.XAdd(c.ctx, c.xAddArgs(c.streamKey, val)).Err()
+}
+
+// Retry sends msg to the retry stream of the group of consumer, through its delay queue if it's delayed,
+// so that other groups don't get it again
+func (c *sClient) Retry(m *core.Msg) error {
+	val, err := c.encoder.Encode(m)
+	if err != nil {
+		return err
+	}
+	if m.DelayAt != nil && m.DelayAt.After(time.Now()) {
+		return c.rds.ZAdd(c.ctx, c.retryQueueKey, redis.Z{
+			Score:  float64(m.DelayAt.UnixMilli()),
+			Member: string(val),
+		}).Err()
+	}
+	return c.rds.XAdd(c.ctx, c.xAddArgs(c.retryStreamKey, val)).Err()
+}
+
+// xAddArgs returns the arguments of XADD to append encoded msg to stream
+func (c *sClient) xAddArgs(stream string, val []byte) *redis.XAddArgs {
+	args := &redis.XAddArgs{
+		Stream: stream,
+		Values: map[string]any{streamMsgField: string(val)},
+		Approx: true,
+	}
+	switch strategy, threshold := c.trimArgs(); strategy {
+	case "MAXLEN":
+		args.MaxLen = c.maxLen
+	case "MINID":
+		args.MinID = threshold
+	}
+	return args
+}
+
+// PushBatch appends normal msgs to stream by XADDs and sends delay msgs by a ZADD in a pipeline
+func (c *sClient) PushBatch(ms []*core.Msg) []error {
+	errs := make([]error, len(ms))
+	var delay []int // indexes of delay msgs
+	var zs []redis.Z
+	addCmds := make(map[int]*redis.StringCmd)
+	pipe := c.rds.Pipeline()
+	for i, m := range ms {
+		val, err := c.encoder.Encode(m)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if m.DelayAt != nil && m.DelayAt.After(time.Now()) {
+			delay = append(delay, i)
+			zs = append(zs, redis.Z{Score: float64(m.DelayAt.UnixMilli()), Member: string(val)})
+		} else {
+			addCmds[i] = pipe.XAdd(c.ctx, c.xAddArgs(c.streamKey, val))
+		}
+	}
+	var zAddCmd *redis.IntCmd
+	if len(zs) > 0 {
+		zAddCmd = pipe.ZAdd(c.ctx, c.delayQueueKey, zs...)
+	}
+	if pipe.Len() > 0 {
+		_, _ = pipe.Exec(c.ctx)
+	}
+	for i, cmd := range addCmds {
+		errs[i] = cmd.Err()
+	}
+	if zAddCmd != nil {
+		setErrs(errs, delay, zAddCmd.Err())
+	}
+	return batchErrs(errs)
+}
+
+// createGroup creates consumer group which starts from the beginning of stream and the retry stream of it,
+// streams are created if missing
+func (c *sClient) createGroup() error {
+	for _, stream := range c.streams() {
+		err := c.rds.XGroupCreateMkStream(c.ctx, stream, c.group, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			// BUSYGROUP means group exists
+			return err
+		}
+	}
+	return nil
+}
+
+// claim claims pending entries which have been idle for claimIdle from other consumers that may be dead,
+// it runs at most once every claimIdle
+func (c *sClient) claim() error {
+	if time.Since(c.lastClaimAt) < c.claimIdle {
+		return nil
+	}
+	scanned := true
+	for _, stream := range c.streams() {
+		msgs, start, err := c.rds.XAutoClaim(c.ctx, &redis.XAutoClaimArgs{
+			Stream:   stream,
+			Group:    c.group,
+			MinIdle:  c.claimIdle,
+			Start:    c.claimStarts[stream],
+			Count:    claimBatch,
+			Consumer: c.consumer,
+		}).Result()
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			c.buffered = append(c.buffered, sEntry{stream: stream, XMessage: msg})
+		}
+		c.claimStarts[stream] = start
+		scanned = scanned && start == "0-0"
+	}
+	if scanned {
+		// the whole pending entries lists have been scanned
+		c.lastClaimAt = time.Now()
+	}
+	return nil
+}
+
+// next returns the next entry, the claimed ones come first
+func (c *sClient) next(ctx context.Context) (sEntry, error) {
+	c.claimMu.Lock()
+	defer c.claimMu.Unlock()
+	for {
+		if err := c.claim(); err != nil {
+			return sEntry{}, err
+		}
+		if len(c.buffered) > 0 {
+			entry := c.buffered[0]
+			c.buffered = c.buffered[1:]
+			return entry, nil
+		}
+		// block for a limited time so that ctx is checked in time
+		streams, err := c.rds.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    c.group,
+			Consumer: c.consumer,
+			Streams:  []string{c.streamKey, c.retryStreamKey, ">", ">"},
+			Count:    1,
+			Block:    fetchBlockTimeout,
+		}).Result()
+		if err == redis.Nil {
+			if ctx.Err() != nil {
+				return sEntry{}, ctx.Err()
+			}
+			continue
+		}
+		if err != nil {
+			return sEntry{}, err
+		}
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				c.buffered = append(c.buffered, sEntry{stream: stream.Stream, XMessage: msg})
+			}
+		}
+	}
+}
+
+func (c *sClient) Fetch(ctx context.Context) (*core.Msg, error) {
+	entry, err := c.next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	val, _ := entry.Values[streamMsgField].(string)
+	m, err := core.DecodeMsgFromStr(val)
+	if err != nil {
+		// bad msg will never be consumed successfully, don't redeliver it
+		c.rds.XAck(c.ctx, entry.stream, c.group, entry.ID)
+		return nil, err
+	}
+	m.SetAckToken(entry)
+	return m, nil
+}
+
+// FetchDelayMsgs moves ready delay msgs to stream, and ready msgs retried by group to its retry stream atomically,
+// so it's safe to be called by many consumers at the same time.
+// The ready msgs will be fetched by Fetch, so it always returns no msg.
+func (c *sClient) FetchDelayMsgs() ([]*core.Msg, error) {
+	for _, keys := range [][]string{{c.delayQueueKey, c.streamKey}, {c.retryQueueKey, c.retryStreamKey}} {
+		for {
+			strategy, threshold := c.trimArgs()
+			n, err := scriptMoveReadyDelayMsgsToStream.Run(c.ctx, c.rds, keys,
+				time.Now().UnixMilli(), delayMsgsBatch, strategy, threshold).Int64()
+			if err != nil {
+				return nil, err
+			}
+			if n < delayMsgsBatch {
+				break
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Ack acknowledges entry of msg, so that it's removed from pending entries list
+func (c *sClient) Ack(m *core.Msg) error {
+	entry, ok := m.AckToken().(sEntry)
+	if !ok {
+		return nil
+	}
+	return c.rds.XAck(c.ctx, entry.stream, c.group, entry.ID).Err()
+}
+
+// Nack leaves entry of msg pending, it'll be claimed and redelivered after ClaimIdle
+func (c *sClient) Nack(m *core.Msg, err error) error {
+	return nil
+}
+
+type SProducer struct {
+	producerCore *core.ProducerCore
+	client       *sClient
+}
+
+// NewSProducer returns a producer and an error
+func NewSProducer(cfg *SConf, opts ...core.ProducerOption) (*SProducer, error) {
+	rds, err := newRedisClient(cfg.Url, cfg.Addrs, cfg.MasterName, cfg.Username, cfg.Password, cfg.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	producer := NewSProducerWithClient(rds, cfg, opts...)
+	producer.client.ownRds = true
+	return producer, nil
+}
+
+// NewSProducerWithClient returns a producer which uses the specified redis client, the connection configuration of cfg is ignored
+func NewSProducerWithClient(rds redis.UniversalClient, cfg *SConf, opts ...core.ProducerOption) *SProducer {
+	producerCore := &core.ProducerCore{
+		Ctx:       context.Background(),
+		Topic:     cfg.Topic,
+		IdCreator: core.DefaultIdCreator,
+	}
+	for _, opt := range opts {
+		opt(producerCore)
+	}
+	client := newSClient(producerCore.Ctx, rds, cfg, producerCore.MsgEncoder())
+	client.replies = newRReplyInbox(client.ctx, rds, client.replyKeyPrefix, producerCore.IdCreator.Create())
+	return &SProducer{
+		producerCore: producerCore,
+		client:       client,
+	}
+}
+
+// MustNewSProducer returns a producer or panic if fails
+func MustNewSProducer(cfg *SConf, opts ...core.ProducerOption) *SProducer {
+	producer, err := NewSProducer(cfg, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return producer
+}
+
+// Send sends data to stream
+func (p *SProducer) Send(data any, opts ...core.MsgOption) (string, error) {
+	return p.producerCore.Send(p.client, core.NewMsg(data, opts...))
+}
+
+// SendMsg sends msg as it is, msg id is kept if it's set
+func (p *SProducer) SendMsg(m *core.Msg) (string, error) {
+	return p.producerCore.Send(p.client, m)
+}
+
+// Request sends data as a request, and blocks until its reply is received or ctx is done
+func (p *SProducer) Request(ctx context.Context, data any, opts ...core.MsgOption) (*core.Msg, error) {
+	return p.producerCore.Request(ctx, p.client, p.client, core.NewMsg(data, opts...))
+}
+
+// SendBatch sends data items to message queue in a round-trip, ids are returned in order, and the id of item failed to be sent is empty.
+// If some items are failed to be sent, a *core.BatchError is returned.
+func (p *SProducer) SendBatch(items []any, opts ...core.MsgOption) ([]string, error) {
+	return p.producerCore.SendBatch(p.client, core.NewMsgs(items, opts...))
+}
+
+// SendAsync buffers data and returns msg id, msg is sent in background and the result is reported by listener.
+// It blocks if the buffer is full, and returns core.ErrProducerClosed after producer is closed.
+func (p *SProducer) SendAsync(data any, opts ...core.MsgOption) (string, error) {
+	return p.producerCore.SendAsync(p.client, core.NewMsg(data, opts...))
+}
+
+// Flush blocks until the msgs buffered by SendAsync before are sent or ctx is done
+func (p *SProducer) Flush(ctx context.Context) error {
+	return p.producerCore.Flush(ctx)
+}
+
+// Close sends all the msgs buffered by SendAsync, and then closes the connection unless the redis client is specified by you.
+// If ctx is done earlier, the buffered msgs are still sent in background and the connection is closed after that.
+func (p *SProducer) Close(ctx context.Context) error {
+	return p.producerCore.Close(ctx, p.client.close)
+}
+
+type SConsumer struct {
+	consumerCore *core.ConsumerCore
+	client       *sClient
+}
+
+// NewSConsumer returns a consumer and error, consumer group is created if missing
+func NewSConsumer(cfg *SConf, handler core.ConsumeFunc, opts ...core.ConsumerOption) (*SConsumer, error) {
+	rds, err := newRedisClient(cfg.Url, cfg.Addrs, cfg.MasterName, cfg.Username, cfg.Password, cfg.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	consumer, err := NewSConsumerWithClient(rds, cfg, handler, opts...)
+	if err != nil {
+		_ = rds.Close()
+		return nil, err
+	}
+	consumer.client.ownRds = true
+	return consumer, nil
+}
+
+// NewSConsumerWithClient returns a consumer which uses the specified redis client and error, the connection configuration of cfg is ignored.
+// Consumer group is created if missing.
+func NewSConsumerWithClient(rds redis.UniversalClient, cfg *SConf, handler core.ConsumeFunc, opts ...core.ConsumerOption) (*SConsumer, error) {
+	if cfg.Group == "" {
+		return nil, errors.New("group must not be empty")
+	}
+	var batchProcess *BatchProcessConf
+	if cfg.BatchProcess == nil {
+		batchProcess = &BatchProcessConf{}
+	} else {
+		batchProcess = cfg.BatchProcess
+	}
+	consumerCore := &core.ConsumerCore{
+		Ctx:                 context.Background(),
+		Topic:               cfg.Topic,
+		WorkersNum:          cfg.Workers,
+		Processors:          goset.NewSortedSet[core.ProcessorType](),
+		ConsumeFunc:         handler,
+		BatchProcessCnt:     batchProcess.Batch,
+		BatchProcessTimeout: time.Duration(batchProcess.Timeout) * time.Second,
+	}
+	for _, opt := range opts {
+		opt(consumerCore)
+	}
+	client := newSClient(consumerCore.Ctx, rds, cfg, consumerCore.MsgEncoder())
+	if err := client.createGroup(); err != nil {
+		return nil, err
+	}
+	return &SConsumer{
+		consumerCore: consumerCore,
+		client:       client,
+	}, nil
+}
+
+// MustNewSConsumer returns a consumer, if it fails, panic
+func MustNewSConsumer(cfg *SConf, handler core.ConsumeFunc, opts ...core.ConsumerOption) *SConsumer {
+	consumer, err := NewSConsumer(cfg, handler, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return consumer
+}
+
+// LoopConsume blocks and consumes msgs in loop with multi goroutine, until it gets a quit signal
+func (c *SConsumer) LoopConsume() {
+	c.consumerCore.LoopConsume(c.client)
+}
+
+// Start starts to consume msgs in background, msgs are fetched until ctx is done or Shutdown is called
+func (c *SConsumer) Start(ctx context.Context) error {
+	return c.consumerCore.Start(ctx, c.client)
+}
+
+// Shutdown stops fetching msgs, waits until the fetched ones are consumed and acknowledged or ctx is done,
+// and then closes the connection unless the redis client is specified by you.
+// The entries unacknowledged will be claimed by other consumers.
+func (c *SConsumer) Shutdown(ctx context.Context) error {
+	err := c.consumerCore.Shutdown(ctx)
+	return errors.Join(err, c.client.close())
+}
@@ -0,0 +1,35 @@
+package windy
+
+import (
+	"github.com/visforest/windy/core"
+)
+
+// Sender is implemented by all the producers
+type Sender interface {
+	Send(data any, opts ...core.MsgOption) (string, error)
+	SendBatch(items []any, opts ...core.MsgOption) ([]string, error)
+}
+
+// TypedProducer is a producer which sends data of type T only
+type TypedProducer[T any] struct {
+	producer Sender
+}
+
+// NewTypedProducer wraps producer into a producer which sends data of type T only
+func NewTypedProducer[T any](producer Sender) *TypedProducer[T] {
+	return &TypedProducer[T]{producer: producer}
+}
+
+// Send sends data to message queue
+func (p *TypedProducer[T]) Send(data T, opts ...core.MsgOption) (string, error) {
+	return p.producer.Send(data, opts...)
+}
+
+// SendBatch sends data items to message queue in a batch, see SendBatch of the producer wrapped
+func (p *TypedProducer[T]) SendBatch(items []T, opts ...core.MsgOption) ([]string, error) {
+	data := make([]any, len(items))
+	for i, item := range items {
+		data[i] = item
+	}
+	return p.producer.SendBatch(data, opts...)
+}